@@ -0,0 +1,116 @@
+package ideamart
+
+/*
+	Subscriber address parsing and normalisation.
+	Ideamart expects addresses in the form tel:94XXXXXXXXX, or the masked tel:passXXXX form it hands out to applications.
+*/
+
+import "strings"
+
+const (
+	// Sends to every subscriber of the application when used as an SMS destination address.
+	BroadcastAddress = "tel:all"
+
+	addressCountryCode  = "94"
+	addressLength       = 11 // Country code and nine digit subscriber number.
+	maskedAddressPrefix = "pass"
+)
+
+// Mobile operator prefixes, following the country code, mapped to operator names.
+var OperatorPrefixes = map[string]string{
+	"70": "Mobitel",
+	"71": "Mobitel",
+	"72": "Hutch",
+	"74": "Dialog",
+	"75": "Airtel",
+	"76": "Dialog",
+	"77": "Dialog",
+	"78": "Hutch",
+}
+
+// A subscriber address.
+// Either MSISDN holds the number in international format without the plus sign (e.g. 94771234567),
+// or Masked holds the masked address Ideamart gave the application in place of a number (e.g. pass...).
+type Address struct {
+	MSISDN string
+	Masked string
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Parses an address in the tel:94771234567, 94771234567, +94771234567 or 0771234567 forms, or a masked address in
+// the tel:pass... form Ideamart gives applications. Any other tel: address must be a number.
+// Spaces and dashes in numbers are ignored. Returns ErrAddrFormatInvalid if the address is not a valid
+// Sri Lankan mobile number or masked address.
+func ParseAddress(s string) (Address, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, subscriptionIDPrefix) {
+		s = s[len(subscriptionIDPrefix):]
+		if len(s) > len(maskedAddressPrefix) && strings.HasPrefix(s, maskedAddressPrefix) && !strings.ContainsAny(s, " \t") {
+			return Address{Masked: s}, nil
+		}
+	}
+	s = strings.NewReplacer(" ", "", "-", "").Replace(s)
+	switch {
+	case strings.HasPrefix(s, "+"+addressCountryCode):
+		s = s[1:]
+	case strings.HasPrefix(s, "0"):
+		s = addressCountryCode + s[1:]
+	}
+	a := Address{MSISDN: s}
+	if len(s) != addressLength || !isDigits(s) || !strings.HasPrefix(s, addressCountryCode) || a.Operator() == "" {
+		return Address{}, ErrAddrFormatInvalid
+	}
+	return a, nil
+}
+
+// Returns the address in the tel: form used by the Ideamart APIs.
+func (a Address) String() string {
+	if a.Masked != "" {
+		return subscriptionIDPrefix + a.Masked
+	}
+	return subscriptionIDPrefix + a.MSISDN
+}
+
+func (a Address) IsMasked() bool {
+	return a.Masked != ""
+}
+
+// Returns the name of the mobile operator the number belongs to, or an empty string if it is unknown or masked.
+func (a Address) Operator() string {
+	if len(a.MSISDN) < len(addressCountryCode)+2 {
+		return ""
+	}
+	return OperatorPrefixes[a.MSISDN[len(addressCountryCode):len(addressCountryCode)+2]]
+}
+
+// Returns the address in tel: form, or the given string unchanged if it cannot be parsed.
+func canonicalAddress(s string) string {
+	if a, err := ParseAddress(s); err == nil {
+		return a.String()
+	}
+	return s
+}
+
+// Returns the recipients in tel: form, and those which are not valid addresses.
+// The broadcast address is passed through as is.
+func normalizeAddresses(addresses []string) (valid, invalid []string) {
+	valid = make([]string, 0, len(addresses))
+	for _, s := range addresses {
+		if s == BroadcastAddress {
+			valid = append(valid, s)
+		} else if a, err := ParseAddress(s); err == nil {
+			valid = append(valid, a.String())
+		} else {
+			invalid = append(invalid, s)
+		}
+	}
+	return valid, invalid
+}
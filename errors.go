@@ -50,6 +50,14 @@ var (
 
 	ErrInvalidJSON   = Error{TypeClientError, "", "Ideamart API sent invalid JSON", true}
 	ErrSendingFailed = Error{TypeClientError, "", "Sending message failed after retries", false}
+
+	ErrOutsideSendWindow   = Error{TypeClientError, "", "Promotional messages cannot be sent outside the allowed send window", true}
+	ErrRecipientSuppressed = Error{TypeClientError, "", "Recipient is on the suppression list", false}
+	ErrMessageCancelled    = Error{TypeClientError, "", "Scheduled message was cancelled", false}
+	ErrUSSDMsgTooLong      = Error{TypeClientError, "", "USSD message does not fit on a single screen", false}
+	ErrSessionNotFound     = Error{TypeClientError, "", "USSD session not found", false}
+
+	ErrUSSDDialStringInvalid = Error{TypeClientError, "", "USSD dial string is invalid", false}
 )
 
 var apiErrMap = map[string]Error{}
@@ -0,0 +1,126 @@
+package ideamart
+
+/*
+	Keyed-hash pseudonymisation of subscriber addresses.
+*/
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+const (
+	pseudonymPrefix = "pid:"
+
+	// How many pseudonyms a Pseudonymizer remembers unless it is created with another limit.
+	DefaultPseudonymizerMaxKnown = 100000
+)
+
+// Replaces subscriber addresses with stable pseudonymous IDs.
+// When set on a client, callbacks receive pseudonyms instead of addresses, request bodies are no longer logged,
+// and pseudonyms can be used wherever the client accepts an address. The pseudonym of an address is an HMAC-SHA256
+// of it under the key, so it stays the same across restarts as long as the key does.
+// Only pseudonyms created by this Pseudonymizer can be mapped back to addresses, and that mapping is only ever done
+// by the clients when sending. It remembers a limited number of the most recently used pseudonyms; one it no longer
+// knows is passed on as is, so sending to it fails with ErrAddrFormatInvalid. Applications which keep pseudonyms for
+// longer should use them with an address they keep themselves, or create the Pseudonymizer with a larger limit.
+type Pseudonymizer struct {
+	key      []byte
+	maxKnown int
+	lock     sync.Mutex
+	lru      list.List
+	known    map[string]*list.Element
+}
+
+// A pseudonym and the address it stands for.
+type knownPseudonym struct {
+	id      string
+	address string
+}
+
+// Returns a new Pseudonymizer which remembers DefaultPseudonymizerMaxKnown pseudonyms.
+// The key should be a secret of at least 32 random bytes.
+func NewPseudonymizer(key []byte) *Pseudonymizer {
+	return NewPseudonymizerWithMaxKnown(key, DefaultPseudonymizerMaxKnown)
+}
+
+// Returns a new Pseudonymizer which remembers at most maxKnown pseudonyms, forgetting the least recently used first.
+func NewPseudonymizerWithMaxKnown(key []byte, maxKnown int) *Pseudonymizer {
+	if len(key) == 0 {
+		panic("Pseudonymizer key is empty")
+	}
+	if maxKnown <= 0 {
+		maxKnown = DefaultPseudonymizerMaxKnown
+	}
+	return &Pseudonymizer{key: append([]byte{}, key...), maxKnown: maxKnown, known: map[string]*list.Element{}}
+}
+
+// Returns the pseudonym for an address. A nil Pseudonymizer returns the address unchanged.
+func (p *Pseudonymizer) Pseudonym(address string) string {
+	if p == nil || address == "" || strings.HasPrefix(address, pseudonymPrefix) {
+		return address
+	}
+	address = canonicalAddress(address)
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(address))
+	id := pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+	p.remember(id, address)
+	return id
+}
+
+// Records the address of a pseudonym as the most recently used, forgetting the least recently used beyond maxKnown.
+func (p *Pseudonymizer) remember(id, address string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.known[id]; ok {
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.known[id] = p.lru.PushFront(knownPseudonym{id, address})
+	for p.lru.Len() > p.maxKnown {
+		e := p.lru.Back()
+		p.lru.Remove(e)
+		delete(p.known, e.Value.(knownPseudonym).id)
+	}
+}
+
+func (p *Pseudonymizer) pseudonymAll(addresses []string) []string {
+	if p == nil {
+		return addresses
+	}
+	ids := make([]string, len(addresses))
+	for i, a := range addresses {
+		ids[i] = p.Pseudonym(a)
+	}
+	return ids
+}
+
+// Returns the address for a known pseudonym. Anything else is returned unchanged, so a pseudonym which is no longer
+// known stays in the pid: form and is then rejected as an invalid address.
+func (p *Pseudonymizer) resolve(id string) string {
+	if p == nil || !strings.HasPrefix(id, pseudonymPrefix) {
+		return id
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.known[id]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(knownPseudonym).address
+	}
+	return id
+}
+
+func (p *Pseudonymizer) resolveAll(ids []string) []string {
+	if p == nil {
+		return ids
+	}
+	addresses := make([]string, len(ids))
+	for i, id := range ids {
+		addresses[i] = p.resolve(id)
+	}
+	return addresses
+}
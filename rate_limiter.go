@@ -0,0 +1,61 @@
+package ideamart
+
+/*
+	Sliding window rate limiter used to throttle requests to the Ideamart API.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+// A sliding window rate limiter.
+// It remembers the start times of the last limit events and only lets a new event start once the oldest
+// of those is at least one window old, so no window of that length can ever contain more than limit events.
+type rateLimiter struct {
+	admission sync.Mutex // Serialises waiters.
+	lock      sync.Mutex // Guards starts and next.
+	window    time.Duration
+	starts    []time.Time
+	next      int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	if limit < 1 {
+		panic("Rate limit must be at least 1")
+	}
+	return &rateLimiter{window: window, starts: make([]time.Time, limit)}
+}
+
+// Blocks until an event can be started without exceeding the limit and records its start time.
+// Waiters are admitted one at a time.
+func (l *rateLimiter) wait() {
+	l.admission.Lock()
+	defer l.admission.Unlock()
+	l.lock.Lock()
+	oldest := l.starts[l.next]
+	l.lock.Unlock()
+	if !oldest.IsZero() {
+		if d := l.window - time.Since(oldest); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	l.lock.Lock()
+	l.starts[l.next] = time.Now()
+	l.next = (l.next + 1) % len(l.starts)
+	l.lock.Unlock()
+}
+
+// Returns the number of events started within the given duration before now.
+// Durations longer than the window are not accounted for beyond the last limit events.
+func (l *rateLimiter) startedWithin(d time.Duration) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := 0
+	for _, t := range l.starts {
+		if !t.IsZero() && time.Since(t) < d {
+			count++
+		}
+	}
+	return count
+}
@@ -82,9 +82,12 @@ func doRequest(endpoint string, request interface{}, response interface{}) error
 	return nil
 }
 
-func unmarshalRequest(req *http.Request, data interface{}) error {
+// Reads a JSON request body into data. The body is logged if logBody is set.
+func unmarshalRequest(req *http.Request, data interface{}, logBody bool) error {
 	reqBody, err := ioutil.ReadAll(req.Body)
-	log.Print(string(reqBody))
+	if logBody {
+		log.Print(string(reqBody))
+	}
 	err = json.Unmarshal(reqBody, data)
 	return err
 }
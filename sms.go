@@ -28,6 +28,13 @@ const (
 
 // The SMS client.
 // DeliveryStatusCallback is called to notify a delivery.
+// SendPolicy restricts when promotional messages may be sent. It is optional.
+// SuppressionList holds addresses which are never sent to. It is optional, and learns from black listing errors.
+// Recipients are normalised to the tel: form before sending, and invalid addresses are reported as failures.
+// The destination responses returned when sending include one for every recipient which was not sent, with Error
+// set to the reason, such as ErrAddrFormatInvalid for an invalid address. If every recipient is invalid, the error
+// returned is ErrAddrFormatInvalid rather than ErrSendingFailed.
+// If Pseudonymizer is set, addresses in results and delivery reports are replaced with pseudonyms.
 type SMSClient struct {
 	ApplicationID          string
 	Password               string
@@ -35,6 +42,9 @@ type SMSClient struct {
 	RetryCount             int
 	MaxAddressCount        int
 	DeliveryStatusCallback func(messageId, address, status string, timestamp time.Time)
+	SendPolicy             *SMSSendPolicy
+	SuppressionList        *SuppressionList
+	Pseudonymizer          *Pseudonymizer
 }
 
 type SMSSendRequest struct {
@@ -101,13 +111,20 @@ func splitAddrSlice(addresses []string, maxSize int) [][]string {
 	return slices
 }
 
+// Sends the request, retrying it up to retryCount times while Ideamart responds with a retryable error.
+// Returns the last retryable error if none of the tries succeeded.
 func (request *SMSSendRequest) sendWithRetries(endpoint string, retryCount int) ([]SMSDestinationResponse, error) {
 	resp := SMSSendResponse{}
+	var lastErr error = ErrSendingFailed
 	for c := 0; c < retryCount; c++ {
 		err := doRequest(endpoint, *request, &resp)
 		if err != nil && err != ErrInvalidJSON {
 			return []SMSDestinationResponse{}, err
 		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
 		if isSuccessCode(resp.StatusCode) {
 			formatDestinationResponses(resp.DestinationResponses)
 			return resp.DestinationResponses, nil
@@ -115,11 +132,12 @@ func (request *SMSSendRequest) sendWithRetries(endpoint string, retryCount int)
 		if isErrorCode(resp.StatusCode) {
 			apiErr := apiErrorFromCode(resp.StatusCode)
 			if !(apiErr == ErrTempSysErr || apiErr == ErrMsgDelivFailed) {
-				return resp.DestinationResponses, ErrSendingFailed
+				return resp.DestinationResponses, apiErr
 			}
+			lastErr = apiErr
 		}
 	}
-	return resp.DestinationResponses, ErrSendingFailed
+	return resp.DestinationResponses, lastErr
 }
 
 func formatDestinationResponses(responses []SMSDestinationResponse) {
@@ -134,31 +152,82 @@ func formatDestinationResponses(responses []SMSDestinationResponse) {
 	}
 }
 
-func (client *SMSClient) sendSMS(sms SMSSendRequest, recipients []string) (destResps []SMSDestinationResponse, failures []string, err error) {
-	destResps = []SMSDestinationResponse{}
-	failures = []string{}
-	addressBlocks := splitAddrSlice(recipients, client.MaxAddressCount)
-	for _, block := range addressBlocks {
+// Returns a response for a recipient which was not sent because of err.
+func failedSMSDestination(address string, err Error) SMSDestinationResponse {
+	return SMSDestinationResponse{Address: address, StatusCode: err.Code, StatusDetail: err.Description, Error: &err}
+}
+
+// Returns the error of a request which failed as a whole. Errors which are not from Ideamart, such as network
+// errors, are retryable.
+func smsRequestError(err error) Error {
+	if e, ok := err.(Error); ok {
+		return e
+	}
+	return Error{TypeClientError, "", err.Error(), true}
+}
+
+// Sends the message to the recipients in blocks of at most MaxAddressCount addresses. The recipients must be
+// addresses, not pseudonyms, and are returned as such. Returns a response for every recipient; those which were not
+// sent have Error set, to ErrAddrFormatInvalid for invalid addresses and ErrRecipientSuppressed for suppressed ones.
+// Every recipient of a request which failed as a whole gets the request's error.
+func (client *SMSClient) send(sms SMSSendRequest, recipients []string) []SMSDestinationResponse {
+	responses := make([]SMSDestinationResponse, 0, len(recipients))
+	valid, invalid := normalizeAddresses(recipients)
+	allowed, suppressed := client.SuppressionList.filter(valid)
+	for _, a := range invalid {
+		responses = append(responses, failedSMSDestination(a, ErrAddrFormatInvalid))
+	}
+	for _, a := range suppressed {
+		responses = append(responses, failedSMSDestination(a, ErrRecipientSuppressed))
+	}
+	for _, block := range splitAddrSlice(allowed, client.MaxAddressCount) {
 		sms.DestinationAddresses = block
 		d, err := sms.sendWithRetries(client.SendEndpoint, client.RetryCount)
 		if err != nil {
-			failures = append(failures, block...)
+			if len(block) == 1 {
+				client.SuppressionList.learn(block[0], err)
+			}
+			// The destination responses, if any, repeat the same failure.
+			for _, a := range block {
+				responses = append(responses, failedSMSDestination(a, smsRequestError(err)))
+			}
+			continue
 		}
 		for _, r := range d {
-			if r.Sent {
-				destResps = append(destResps, r)
-			} else {
-				failures = append(failures, r.Address)
+			if !r.Sent && r.Error != nil {
+				client.SuppressionList.learn(r.Address, *r.Error)
+			}
+			responses = append(responses, r)
+		}
+	}
+	return responses
+}
+
+func (client *SMSClient) sendSMS(sms SMSSendRequest, recipients []string) (destResps []SMSDestinationResponse, failures []string, err error) {
+	destResps = []SMSDestinationResponse{}
+	failures = []string{}
+	invalid := 0
+	for _, r := range client.send(sms, client.Pseudonymizer.resolveAll(recipients)) {
+		r.Address = client.Pseudonymizer.Pseudonym(r.Address)
+		destResps = append(destResps, r)
+		if !r.Sent {
+			failures = append(failures, r.Address)
+			if *r.Error == ErrAddrFormatInvalid {
+				invalid++
 			}
 		}
 	}
-	if len(failures) == len(recipients) {
+	switch {
+	case invalid > 0 && invalid == len(recipients):
+		return destResps, failures, ErrAddrFormatInvalid
+	case len(failures) == len(recipients):
 		return destResps, failures, ErrSendingFailed
 	}
 	return destResps, failures, nil
 }
 
-func (client *SMSClient) SendTextMessage(message string, recipients []string, chargingAmount float32, requestDeliveryReports bool) (destResps []SMSDestinationResponse, failures []string, err error) {
+// Returns a request sending the message, without any destination addresses.
+func (client *SMSClient) newSendRequest(message string, chargingAmount float32, requestDeliveryReports bool) SMSSendRequest {
 	smsReq := SMSSendRequest{
 		ApplicationID: client.ApplicationID,
 		Password:      client.Password,
@@ -172,13 +241,31 @@ func (client *SMSClient) SendTextMessage(message string, recipients []string, ch
 		d := "1"
 		smsReq.DeliveryStatusRequest = &d
 	}
-	return client.sendSMS(smsReq, recipients)
+	return smsReq
+}
+
+// Sends a transactional text message. Transactional messages are not restricted by the send policy.
+func (client *SMSClient) SendTextMessage(message string, recipients []string, chargingAmount float32, requestDeliveryReports bool) (destResps []SMSDestinationResponse, failures []string, err error) {
+	return client.sendTextMessage(SMSCategoryTransactional, message, recipients, chargingAmount, requestDeliveryReports)
+}
+
+// Sends a promotional text message.
+// Returns ErrOutsideSendWindow without sending anything if the send policy does not allow it at this time.
+func (client *SMSClient) SendPromotionalTextMessage(message string, recipients []string, chargingAmount float32, requestDeliveryReports bool) (destResps []SMSDestinationResponse, failures []string, err error) {
+	return client.sendTextMessage(SMSCategoryPromotional, message, recipients, chargingAmount, requestDeliveryReports)
+}
+
+func (client *SMSClient) sendTextMessage(category SMSCategory, message string, recipients []string, chargingAmount float32, requestDeliveryReports bool) (destResps []SMSDestinationResponse, failures []string, err error) {
+	if !client.SendPolicy.Allows(category, time.Now()) {
+		return []SMSDestinationResponse{}, recipients, ErrOutsideSendWindow
+	}
+	return client.sendSMS(client.newSendRequest(message, chargingAmount, requestDeliveryReports), recipients)
 }
 
 // This method should be attached as the handler for the delivery report endpoint.
 func (client *SMSClient) HandleDeliveryReport(res http.ResponseWriter, req *http.Request) {
 	report := SMSDeliveryReport{}
-	err := unmarshalRequest(req, &report)
+	err := unmarshalRequest(req, &report, client.Pseudonymizer == nil)
 	if err != nil {
 		sendErrorResponse(res)
 	} else {
@@ -186,5 +273,5 @@ func (client *SMSClient) HandleDeliveryReport(res http.ResponseWriter, req *http
 	}
 	req.Body.Close()
 	report.Timestamp = parseSMSTimestamp(report.RawTimestamp)
-	go client.DeliveryStatusCallback(report.MessageID, report.DestinationAddress, report.DeliveryStatus, report.Timestamp)
+	go client.DeliveryStatusCallback(report.MessageID, client.Pseudonymizer.Pseudonym(report.DestinationAddress), report.DeliveryStatus, report.Timestamp)
 }
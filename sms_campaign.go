@@ -0,0 +1,303 @@
+package ideamart
+
+/*
+	Bulk SMS campaigns.
+	Recipients are imported from CSV, each gets a message personalised from a template, and everything is sent
+	through an SMS queue. Results are appended to a checkpoint file so that an interrupted campaign can be resumed.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+)
+
+// SMS campaign recipient status values
+const (
+	SMSCampaignPending = "PENDING"
+	SMSCampaignSent    = "SENT"
+	SMSCampaignFailed  = "FAILED"
+
+	smsCampaignDefaultAddressColumn   = "address"
+	smsCampaignDefaultMaxOutstanding  = 100
+	smsCampaignDefaultCheckpointEvery = 100
+)
+
+// A campaign recipient and the result of sending to it.
+// Row is the 1-based data row number in the imported CSV, and Fields holds the row values by column name.
+type SMSCampaignRecipient struct {
+	Row       int               `json:"row"`
+	Address   string            `json:"address"`
+	Fields    map[string]string `json:"-"`
+	Status    string            `json:"status"`
+	MessageID string            `json:"messageId,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// A bulk SMS campaign.
+// Template is executed with the CSV row fields of each recipient, e.g. "Hi {{.name}}".
+// AddressColumn is the CSV column holding the recipient address and defaults to "address".
+// CheckpointPath is the file progress is saved to; if empty, progress is not saved. Results are appended to it as
+// they arrive, one JSON record per line, and it is compacted to the latest result of each recipient once the campaign
+// has run. Progress is saved after every CheckpointEvery results, and at most MaxOutstanding messages
+// are handed to the queue at a time. Run uses the defaults of 100 for either if it is not positive.
+type SMSCampaign struct {
+	ID              string
+	Template        *template.Template
+	AddressColumn   string
+	ChargingAmount  float32
+	ReportDelivery  bool
+	Promotional     bool
+	CheckpointPath  string
+	CheckpointEvery int
+	MaxOutstanding  int
+
+	lock       sync.Mutex
+	recipients []SMSCampaignRecipient
+	results    chan SMSCampaignRecipient
+}
+
+// Returns a new campaign with the given message template.
+func NewSMSCampaign(id, messageTemplate, checkpointPath string) (*SMSCampaign, error) {
+	t, err := template.New(id).Option("missingkey=error").Parse(messageTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &SMSCampaign{
+		ID:              id,
+		Template:        t,
+		AddressColumn:   smsCampaignDefaultAddressColumn,
+		CheckpointPath:  checkpointPath,
+		CheckpointEvery: smsCampaignDefaultCheckpointEvery,
+		MaxOutstanding:  smsCampaignDefaultMaxOutstanding,
+	}, nil
+}
+
+// Imports recipients from CSV. The first record must be a header naming the columns.
+// Rows without an address are skipped.
+func (c *SMSCampaign) LoadRecipientsCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	addrCol := -1
+	for i, name := range header {
+		if name == c.AddressColumn {
+			addrCol = i
+		}
+	}
+	if addrCol < 0 {
+		return fmt.Errorf("CSV has no %q column", c.AddressColumn)
+	}
+	recipients := []SMSCampaignRecipient{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if record[addrCol] == "" {
+			continue
+		}
+		fields := map[string]string{}
+		for i, name := range header {
+			fields[name] = record[i]
+		}
+		recipients = append(recipients, SMSCampaignRecipient{Row: row, Address: record[addrCol], Fields: fields, Status: SMSCampaignPending})
+	}
+	c.lock.Lock()
+	c.recipients = recipients
+	c.lock.Unlock()
+	return nil
+}
+
+// Reads the results saved in the checkpoint file. Later results for a recipient replace earlier ones.
+// Lines which cannot be read, such as one left partly written by a crash, are skipped.
+func readSMSCampaignCheckpoint(data []byte) []SMSCampaignRecipient {
+	saved := []SMSCampaignRecipient{}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		r := SMSCampaignRecipient{}
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &r) != nil {
+			continue
+		}
+		saved = append(saved, r)
+	}
+	return saved
+}
+
+// Applies the results saved in the checkpoint file, if there is one, to the loaded recipients.
+func (c *SMSCampaign) restore() error {
+	if c.CheckpointPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.CheckpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := readSMSCampaignCheckpoint(data)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	byRow := map[int]*SMSCampaignRecipient{}
+	for i := range c.recipients {
+		byRow[c.recipients[i].Row] = &c.recipients[i]
+	}
+	for _, s := range saved {
+		if r := byRow[s.Row]; r != nil && r.Address == s.Address {
+			r.Status, r.MessageID, r.Error = s.Status, s.MessageID, s.Error
+		}
+	}
+	return nil
+}
+
+// Appends results to the checkpoint file until the results channel is closed, flushing after every CheckpointEvery
+// results. Runs in its own goroutine so that the SMS queue workers reporting results never wait for the disk.
+func (c *SMSCampaign) appendResults(results <-chan SMSCampaignRecipient, done chan<- struct{}) {
+	defer close(done)
+	var out *bufio.Writer
+	if c.CheckpointPath != "" {
+		file, err := os.OpenFile(c.CheckpointPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Print("Error saving SMS campaign checkpoint: ", err)
+		} else {
+			defer file.Close()
+			out = bufio.NewWriter(file)
+		}
+	}
+	unsaved := 0
+	for r := range results {
+		if out == nil {
+			continue
+		}
+		data, _ := json.Marshal(r)
+		out.Write(append(data, '\n'))
+		if unsaved++; unsaved >= c.CheckpointEvery {
+			unsaved = 0
+			if err := out.Flush(); err != nil {
+				log.Print("Error saving SMS campaign checkpoint: ", err)
+			}
+		}
+	}
+	if out != nil {
+		if err := out.Flush(); err != nil {
+			log.Print("Error saving SMS campaign checkpoint: ", err)
+		}
+	}
+}
+
+// Rewrites the checkpoint file with only the latest result of each recipient.
+func (c *SMSCampaign) compactCheckpoint() error {
+	if c.CheckpointPath == "" {
+		return nil
+	}
+	data := bytes.Buffer{}
+	encoder := json.NewEncoder(&data)
+	for _, r := range c.Recipients() {
+		if r.Status != SMSCampaignPending {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+	tmp := c.CheckpointPath + ".tmp"
+	if err := os.WriteFile(tmp, data.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.CheckpointPath)
+}
+
+// Records the result for a recipient and passes it on to be saved.
+func (c *SMSCampaign) setResult(i int, messageId string, err error) {
+	c.lock.Lock()
+	r := &c.recipients[i]
+	if err != nil {
+		r.Status, r.Error = SMSCampaignFailed, err.Error()
+	} else {
+		r.Status, r.MessageID = SMSCampaignSent, messageId
+	}
+	result := *r
+	c.lock.Unlock()
+	c.results <- result
+}
+
+// Sends the campaign to every recipient which has not been sent to or failed yet, resuming from the checkpoint
+// file if it exists. The queue must be started. Blocks until all recipients have a result.
+// Recipients which were handed to the queue but had no result when the campaign was interrupted are sent again.
+func (c *SMSCampaign) Run(q *SMSQueue) error {
+	if c.MaxOutstanding <= 0 {
+		c.MaxOutstanding = smsCampaignDefaultMaxOutstanding
+	}
+	if c.CheckpointEvery <= 0 {
+		c.CheckpointEvery = smsCampaignDefaultCheckpointEvery
+	}
+	if err := c.restore(); err != nil {
+		return err
+	}
+	c.results = make(chan SMSCampaignRecipient, c.MaxOutstanding)
+	saved := make(chan struct{})
+	go c.appendResults(c.results, saved)
+	outstanding := make(chan struct{}, c.MaxOutstanding)
+	var wg sync.WaitGroup
+	for i := range c.recipients {
+		c.lock.Lock()
+		r := c.recipients[i]
+		c.lock.Unlock()
+		if r.Status != SMSCampaignPending {
+			continue
+		}
+		message := bytes.Buffer{}
+		if err := c.Template.Execute(&message, r.Fields); err != nil {
+			c.setResult(i, "", err)
+			continue
+		}
+		i := i
+		category := SMSCategoryTransactional
+		if c.Promotional {
+			category = SMSCategoryPromotional
+		}
+		m := newSMSMessage(c.ID+":"+strconv.Itoa(r.Row), message.String(), []string{r.Address}, c.ChargingAmount, c.ReportDelivery, category)
+		m.done = func(recipient, smsMessageId string, err error) {
+			c.setResult(i, smsMessageId, err)
+			<-outstanding
+			wg.Done()
+		}
+		outstanding <- struct{}{}
+		wg.Add(1)
+		q.submitMessage(m)
+	}
+	wg.Wait()
+	close(c.results)
+	<-saved
+	return c.compactCheckpoint()
+}
+
+// Returns a copy of the recipients and their current results.
+func (c *SMSCampaign) Recipients() []SMSCampaignRecipient {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]SMSCampaignRecipient{}, c.recipients...)
+}
+
+// Writes a CSV report with the result for each recipient.
+func (c *SMSCampaign) WriteReport(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"row", "address", "status", "messageId", "error"})
+	for _, r := range c.Recipients() {
+		writer.Write([]string{strconv.Itoa(r.Row), r.Address, r.Status, r.MessageID, r.Error})
+	}
+	writer.Flush()
+	return writer.Error()
+}
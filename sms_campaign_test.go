@@ -0,0 +1,93 @@
+package ideamart
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func newTestSMSCampaignQueue(t *testing.T) *SMSQueue {
+	server := newSMSTestServer(0, 0)
+	t.Cleanup(server.Close)
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1}
+	q := NewSMSQueue(client, 100, 100, 0, nil)
+	go q.Start()
+	return &q
+}
+
+func testSMSCampaignCSV(rows int) string {
+	csv := "address,name\n"
+	for i := 0; i < rows; i++ {
+		csv += fmt.Sprintf("tel:9477100%04d,Name %d\n", i, i)
+	}
+	return csv
+}
+
+func runSMSCampaign(t *testing.T, c *SMSCampaign, q *SMSQueue) {
+	done := make(chan error)
+	go func() { done <- c.Run(q) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("SMS campaign did not finish")
+	}
+}
+
+func TestSMSCampaignDefaultsZeroLimits(t *testing.T) {
+	c := &SMSCampaign{ID: "c", Template: template.Must(template.New("c").Parse("Hi {{.name}}")), AddressColumn: "address"}
+	if err := c.LoadRecipientsCSV(strings.NewReader(testSMSCampaignCSV(5))); err != nil {
+		t.Fatal(err)
+	}
+	runSMSCampaign(t, c, newTestSMSCampaignQueue(t))
+	for _, r := range c.Recipients() {
+		if r.Status != SMSCampaignSent {
+			t.Errorf("row %d: got status %s, want %s", r.Row, r.Status, SMSCampaignSent)
+		}
+	}
+}
+
+func TestSMSCampaignResumesFromCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	saved := `{"row":1,"address":"tel:94771000000","status":"FAILED","error":"earlier"}
+{"row":1,"address":"tel:94771000000","status":"SENT","messageId":"m1"}
+{"row":2,"address":"tel:9477`
+	if err := os.WriteFile(path, []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewSMSCampaign("c", "Hi {{.name}}", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CheckpointEvery = 2
+	if err := c.LoadRecipientsCSV(strings.NewReader(testSMSCampaignCSV(5))); err != nil {
+		t.Fatal(err)
+	}
+	q := newTestSMSCampaignQueue(t)
+	runSMSCampaign(t, c, q)
+	if sent := q.Stats().Sent; sent != 4 {
+		t.Errorf("got %d messages sent, want 4", sent)
+	}
+	if r := c.Recipients()[0]; r.Status != SMSCampaignSent || r.MessageID != "m1" {
+		t.Errorf("got first recipient %+v, want the saved result", r)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := readSMSCampaignCheckpoint(data)
+	if len(restored) != 5 || strings.Count(string(data), "\n") != 5 {
+		t.Errorf("got checkpoint %q, want one line for each of the 5 recipients", data)
+	}
+	for _, r := range restored {
+		if r.Status != SMSCampaignSent {
+			t.Errorf("row %d: got status %s in checkpoint, want %s", r.Row, r.Status, SMSCampaignSent)
+		}
+	}
+}
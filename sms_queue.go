@@ -2,13 +2,20 @@ package ideamart
 
 /*
 	Request throttling SMS queue. Auto-retries when retryable errors are encountered.
+	Every queued message maps to exactly one request to the Ideamart API, and every request
+	(including retries) has to pass through the queue's rate limiter before it is sent.
 */
 
 import (
 	"log"
+	"sync"
 	"time"
 )
 
+// The length of the rate limiting window. Slightly longer than a second so that
+// network jitter cannot squeeze more than messagesPerSecond requests into a second at Ideamart's end.
+const smsQueueRateWindow = time.Second + 50*time.Millisecond
+
 type smsMessage struct {
 	ID             string
 	message        string
@@ -16,28 +23,56 @@ type smsMessage struct {
 	chargingAmount float32
 	reportDelivery bool
 	retries        int
+	category       SMSCategory
+	// Optional hook called for every recipient once it has been sent (err is nil) or given up on.
+	done func(recipient, smsMessageId string, err error)
+}
+
+func newSMSMessage(id, message string, recipients []string, chargingAmount float32, reportDelivery bool, category SMSCategory) smsMessage {
+	return smsMessage{ID: id, message: message, recipients: recipients, chargingAmount: chargingAmount, reportDelivery: reportDelivery, category: category}
 }
 
 // SMS Queue with auto-retrying for retryable errors.
+// Messages are sent by a fixed pool of workers, so at most maxInFlight requests are pending at any time,
+// and no more than messagesPerSecond requests are started within any one second window.
 type SMSQueue struct {
 	channel                 chan smsMessage
 	maxRetryCount           int
 	messagesPerSecond       int
+	maxInFlight             int
 	started                 bool
+	limiter                 *rateLimiter
+	counters                *smsQueueCounters
+	scheduler               *smsScheduler
 	client                  SMSClient
 	sentMessageCallbackFunc func(id, smsMessage, recipient, smsMessageId string)
+	statsInterval           time.Duration
+	statsCallbackFunc       func(stats SMSQueueStats)
 }
 
-// Enqueues a message in the SMS queue.
+// Enqueues a transactional message in the SMS queue.
 func (q *SMSQueue) EnqueueMessage(id, message string, recipients []string, chargingAmount float32, reportDelivery bool) {
-	go func() {
-		m := smsMessage{id, message, recipients, chargingAmount, reportDelivery, 0}
-		q.enqueueMessage(m)
-	}()
+	q.submitMessage(newSMSMessage(id, message, recipients, chargingAmount, reportDelivery, SMSCategoryTransactional))
+}
+
+// Enqueues a promotional message in the SMS queue.
+// If the client's send policy does not allow sending it when it reaches the front of the queue,
+// it is held back until the next allowed window.
+func (q *SMSQueue) EnqueuePromotionalMessage(id, message string, recipients []string, chargingAmount float32, reportDelivery bool) {
+	q.submitMessage(newSMSMessage(id, message, recipients, chargingAmount, reportDelivery, SMSCategoryPromotional))
+}
+
+// Queues a new message without blocking the caller.
+func (q *SMSQueue) submitMessage(m smsMessage) {
+	q.counters.enqueued.Add(int64(len(m.recipients)))
+	go q.enqueueMessage(m)
 }
 
+// Splits the message into blocks which can each be sent in a single request and queues them.
+// The recipients count towards the queue depth from now on, including while waiting for space in a full queue.
 func (q *SMSQueue) enqueueMessage(m smsMessage) {
-	addrBlocks := splitAddrSlice(m.recipients, q.messagesPerSecond*q.client.MaxAddressCount)
+	q.counters.pending.Add(int64(len(m.recipients)))
+	addrBlocks := splitAddrSlice(m.recipients, q.client.MaxAddressCount)
 	for _, block := range addrBlocks {
 		nm := m
 		nm.recipients = block
@@ -45,66 +80,164 @@ func (q *SMSQueue) enqueueMessage(m smsMessage) {
 	}
 }
 
+// Requeues the message without blocking the calling worker, which could otherwise deadlock on a full queue.
 func (q *SMSQueue) requeueMessage(m smsMessage) {
 	if m.retries < q.maxRetryCount {
 		m.retries++
-		q.enqueueMessage(m)
+		q.counters.retried.Add(int64(len(m.recipients)))
+		go q.enqueueMessage(m)
+	} else {
+		q.counters.deadLettered.Add(int64(len(m.recipients)))
+		if m.done != nil {
+			for _, r := range m.recipients {
+				m.done(r, "", ErrSendingFailed)
+			}
+		}
 	}
 }
 
+// Sends the message and reports its recipients. Recipients which failed with a retryable error are requeued, and the
+// others are given up on with their error. The queue keeps the recipients' addresses, and replaces them with
+// pseudonyms only when passing them to the callback and the done hook.
 func (q *SMSQueue) sendMessage(m smsMessage) {
-	responses, failures, err := q.client.SendTextMessage(m.message, m.recipients, m.chargingAmount, m.reportDelivery)
-	if err != nil {
+	retry := []string{}
+	sms := q.client.newSendRequest(m.message, m.chargingAmount, m.reportDelivery)
+	for _, r := range q.client.send(sms, m.recipients) {
+		switch {
+		case r.Sent:
+			q.counters.sent.Add(1)
+			address := q.client.Pseudonymizer.Pseudonym(r.Address)
+			if q.sentMessageCallbackFunc != nil {
+				go q.sentMessageCallbackFunc(m.ID, m.message, address, r.MessageID)
+			}
+			if m.done != nil {
+				m.done(address, r.MessageID, nil)
+			}
+		case r.Error.Retryable:
+			retry = append(retry, r.Address)
+		default:
+			if *r.Error == ErrRecipientSuppressed {
+				q.counters.suppressed.Add(1)
+			} else {
+				q.counters.failed.Add(1)
+				q.counters.deadLettered.Add(1)
+			}
+			if m.done != nil {
+				m.done(q.client.Pseudonymizer.Pseudonym(r.Address), "", *r.Error)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		q.counters.failed.Add(int64(len(retry)))
+		m.recipients = retry
 		q.requeueMessage(m)
-		return
 	}
-	for i := range responses {
-		if responses[i].Error != nil && responses[i].Error.Retryable {
-			failures = append(failures, responses[i].Address)
-		} else {
-			go q.sentMessageCallbackFunc(m.ID, m.message, responses[i].Address, responses[i].MessageID)
+}
+
+// Normalises the recipient addresses and removes those which are invalid or on the client's suppression list,
+// reporting them as given up on.
+func (q *SMSQueue) dropUnsendable(m smsMessage) smsMessage {
+	valid, invalid := normalizeAddresses(q.client.Pseudonymizer.resolveAll(m.recipients))
+	allowed, suppressed := q.client.SuppressionList.filter(valid)
+	q.counters.deadLettered.Add(int64(len(invalid)))
+	q.counters.suppressed.Add(int64(len(suppressed)))
+	if m.done != nil {
+		for _, r := range invalid {
+			m.done(q.client.Pseudonymizer.Pseudonym(r), "", ErrAddrFormatInvalid)
+		}
+		for _, r := range suppressed {
+			m.done(q.client.Pseudonymizer.Pseudonym(r), "", ErrRecipientSuppressed)
 		}
 	}
-	if len(failures) > 0 {
-		newM := smsMessage{m.ID, m.message, failures, m.chargingAmount, m.reportDelivery, m.retries + 1}
-		q.requeueMessage(newM)
+	m.recipients = allowed
+	return m
+}
+
+// Hands the message to the scheduler until the next allowed window if the send policy does not allow sending it now.
+func (q *SMSQueue) heldBack(m smsMessage) bool {
+	now := time.Now()
+	if q.client.SendPolicy.Allows(m.category, now) {
+		return false
+	}
+	q.scheduler.holdBack(m, q.client.SendPolicy.NextAllowed(m.category, now))
+	return true
+}
+
+// Takes messages off the queue and sends them, waiting for the rate limiter before each request.
+// Messages which may not be sent at this time are handed to the scheduler until the next allowed window,
+// before waiting for the rate limiter so that they do not hold up messages which can be sent.
+func (q *SMSQueue) dispatch() {
+	for m := range q.channel {
+		q.counters.pending.Add(-int64(len(m.recipients)))
+		if m = q.dropUnsendable(m); len(m.recipients) == 0 || q.heldBack(m) {
+			continue
+		}
+		q.limiter.wait()
+		// The window may have closed while waiting.
+		if q.heldBack(m) {
+			continue
+		}
+		q.counters.inFlight.Add(1)
+		q.sendMessage(m)
+		q.counters.inFlight.Add(-1)
 	}
 }
 
 // Starts the SMS queue. This method should be called only once. Subsequent calls will not do anything.
+// It blocks for as long as the queue is running.
 func (q *SMSQueue) Start() {
 	if q.started {
 		log.Print("SMS queue is already running.")
 		return
 	}
 	q.started = true
-	sentCount := 0
-	for {
-		if sentCount >= q.messagesPerSecond {
-			time.Sleep(time.Second)
-			sentCount = 0
-		}
-		m := <-q.channel
-		go q.sendMessage(m)
-		sentCount += len(m.recipients) / q.client.MaxAddressCount
-		if len(m.recipients)%q.client.MaxAddressCount != 0 {
-			sentCount++
-		}
+	if q.statsCallbackFunc != nil && q.statsInterval > 0 {
+		go q.reportStats()
 	}
+	go q.scheduler.run(q.submitMessage, func(m smsMessage) { go q.enqueueMessage(m) })
+	var workers sync.WaitGroup
+	for i := 0; i < q.maxInFlight; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			q.dispatch()
+		}()
+	}
+	workers.Wait()
 }
 
 // Initializes and returns a new SMS queue.
 // Make sure that an application has only one queue if request throttling should be properly functional.
+// messagesPerSecond is the maximum number of requests sent to Ideamart per second, and also the maximum
+// number of requests in flight. Use NewSMSQueueWithMaxInFlight to set the latter separately.
 func NewSMSQueue(client *SMSClient, capacity, messagesPerSecond, maxRetryCount int, sendCallback func(id, smsMessage, recipient, smsMessageId string)) SMSQueue {
+	return NewSMSQueueWithMaxInFlight(client, capacity, messagesPerSecond, messagesPerSecond, maxRetryCount, sendCallback)
+}
+
+// Initializes and returns a new SMS queue which sends at most maxInFlight requests concurrently.
+// Retries are handled by the queue so that they are throttled too; the client's RetryCount is not used.
+func NewSMSQueueWithMaxInFlight(client *SMSClient, capacity, messagesPerSecond, maxInFlight, maxRetryCount int, sendCallback func(id, smsMessage, recipient, smsMessageId string)) SMSQueue {
 	if client == nil {
 		panic("SMS client is nil")
 	}
+	if client.MaxAddressCount < 1 {
+		panic("SMS client MaxAddressCount must be at least 1")
+	}
+	if maxInFlight < 1 {
+		panic("SMS queue maxInFlight must be at least 1")
+	}
 	q := SMSQueue{
 		channel:                 make(chan smsMessage, capacity),
 		maxRetryCount:           maxRetryCount,
 		messagesPerSecond:       messagesPerSecond,
+		maxInFlight:             maxInFlight,
+		limiter:                 newRateLimiter(messagesPerSecond, smsQueueRateWindow),
+		counters:                &smsQueueCounters{},
+		scheduler:               newSMSScheduler(),
 		client:                  *client,
 		sentMessageCallbackFunc: sendCallback,
 	}
+	// Each send must be exactly one request for the limiter to account for it.
+	q.client.RetryCount = 1
 	return q
 }
@@ -0,0 +1,77 @@
+package ideamart
+
+/*
+	Counters and snapshots for monitoring an SMS queue.
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A point in time snapshot of the state of an SMS queue.
+// Enqueued, Sent, Failed, Retried and DeadLettered are cumulative recipient counts since the queue was created.
+// Failed counts every failed delivery attempt, so a recipient which is retried may be counted more than once.
+// DeadLettered counts recipients that were given up on after exhausting the retries, after a non-retryable error,
+// for having invalid addresses or because their held back message was cancelled, and Suppressed those that were
+// dropped because they are on the client's suppression list.
+// Depth is the number of recipients waiting to be sent, including those of messages waiting for space in a full queue,
+// so it keeps growing with the backlog. InFlight is the number of requests currently being sent.
+// Scheduled is the number of messages held for sending at a later time; they are counted as Enqueued once due.
+// EffectiveTPS is the number of requests started during the last second.
+type SMSQueueStats struct {
+	Enqueued     int64
+	Sent         int64
+	Failed       int64
+	Retried      int64
+	DeadLettered int64
+	Suppressed   int64
+	Depth        int64
+	InFlight     int
+	Scheduled    int
+	EffectiveTPS float64
+	Timestamp    time.Time
+}
+
+type smsQueueCounters struct {
+	enqueued     atomic.Int64
+	sent         atomic.Int64
+	failed       atomic.Int64
+	retried      atomic.Int64
+	deadLettered atomic.Int64
+	suppressed   atomic.Int64
+	inFlight     atomic.Int64
+	pending      atomic.Int64
+}
+
+// Returns a snapshot of the queue statistics. Safe to call from any goroutine.
+func (q *SMSQueue) Stats() SMSQueueStats {
+	return SMSQueueStats{
+		Enqueued:     q.counters.enqueued.Load(),
+		Sent:         q.counters.sent.Load(),
+		Failed:       q.counters.failed.Load(),
+		Retried:      q.counters.retried.Load(),
+		DeadLettered: q.counters.deadLettered.Load(),
+		Suppressed:   q.counters.suppressed.Load(),
+		Depth:        q.counters.pending.Load(),
+		InFlight:     int(q.counters.inFlight.Load()),
+		Scheduled:    q.scheduler.size(),
+		EffectiveTPS: float64(q.limiter.startedWithin(time.Second)),
+		Timestamp:    time.Now(),
+	}
+}
+
+// Sets a callback to be called with a statistics snapshot every interval while the queue is running.
+// This should be called before Start.
+func (q *SMSQueue) SetStatsCallback(interval time.Duration, callback func(stats SMSQueueStats)) {
+	q.statsInterval = interval
+	q.statsCallbackFunc = callback
+}
+
+func (q *SMSQueue) reportStats() {
+	ticker := time.NewTicker(q.statsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.statsCallbackFunc(q.Stats())
+	}
+}
@@ -0,0 +1,268 @@
+package ideamart
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake Ideamart SMS endpoint which records when requests arrive and how many are handled at once.
+// Every failEvery'th request fails with a retryable error, so that the queue retries it. If destinationStatus is set,
+// the requests succeed but every destination gets that status code. onRequest, if set, is called for every request
+// with the lock held.
+type smsTestServer struct {
+	*httptest.Server
+	failEvery         int
+	delay             time.Duration
+	destinationStatus string
+	onRequest         func()
+	lock              sync.Mutex
+	starts            []time.Time
+	inFlight          int
+	maxInFlight       int
+}
+
+func newSMSTestServer(failEvery int, delay time.Duration) *smsTestServer {
+	s := &smsTestServer{failEvery: failEvery, delay: delay}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *smsTestServer) handle(res http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	smsReq := SMSSendRequest{}
+	json.NewDecoder(req.Body).Decode(&smsReq)
+	s.lock.Lock()
+	s.starts = append(s.starts, now)
+	n := len(s.starts)
+	fail := s.failEvery > 0 && n%s.failEvery == 0
+	if s.onRequest != nil {
+		s.onRequest()
+	}
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.lock.Unlock()
+	time.Sleep(s.delay)
+	resp := SMSSendResponse{StatusCode: "S1000", StatusDetail: "Success"}
+	if fail {
+		resp.StatusCode = ErrTempSysErr.Code
+	}
+	for i, addr := range smsReq.DestinationAddresses {
+		d := SMSDestinationResponse{Address: addr, MessageID: fmt.Sprint(n, "-", i), StatusCode: resp.StatusCode}
+		if s.destinationStatus != "" {
+			d.StatusCode = s.destinationStatus
+		}
+		resp.DestinationResponses = append(resp.DestinationResponses, d)
+	}
+	json.NewEncoder(res).Encode(resp)
+	s.lock.Lock()
+	s.inFlight--
+	s.lock.Unlock()
+}
+
+func (s *smsTestServer) requestStarts() []time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	starts := append([]time.Time{}, s.starts...)
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	return starts
+}
+
+func waitForSMSQueue(t *testing.T, q *SMSQueue, done func(SMSQueueStats) bool) SMSQueueStats {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		stats := q.Stats()
+		if done(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("SMS queue did not finish: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Checks that no window holds more than limit request starts.
+func checkRateLimit(t *testing.T, starts []time.Time, limit int, window time.Duration) {
+	for i := limit; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-limit]); d < window {
+			t.Errorf("requests %d to %d started within %v, want at most %d per %v", i-limit+1, i+1, d, limit, window)
+		}
+	}
+}
+
+func TestSMSQueueRateLimit(t *testing.T) {
+	const messagesPerSecond, messages = 5, 18
+	server := newSMSTestServer(4, 0)
+	defer server.Close()
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1}
+	q := NewSMSQueue(client, 4, messagesPerSecond, 5, nil)
+	go q.Start()
+	for i := 0; i < messages; i++ {
+		q.EnqueueMessage(fmt.Sprint(i), "Hello", []string{fmt.Sprintf("tel:9477100%04d", i)}, 0, false)
+	}
+	stats := waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Sent+s.DeadLettered == messages })
+	if stats.Sent != messages || stats.Retried == 0 {
+		t.Errorf("got %d sent and %d retried, want %d sent with retries", stats.Sent, stats.Retried, messages)
+	}
+	starts := server.requestStarts()
+	if len(starts) != messages+int(stats.Retried) {
+		t.Errorf("got %d requests, want %d", len(starts), messages+int(stats.Retried))
+	}
+	// Arrival times jitter by a little, so allow for half of the window's margin over a second.
+	checkRateLimit(t, starts, messagesPerSecond, smsQueueRateWindow-(smsQueueRateWindow-time.Second)/2)
+}
+
+func TestSMSQueueMaxInFlight(t *testing.T) {
+	const messagesPerSecond, maxInFlight, messages = 20, 2, 12
+	server := newSMSTestServer(0, 200*time.Millisecond)
+	defer server.Close()
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1}
+	q := NewSMSQueueWithMaxInFlight(client, 100, messagesPerSecond, maxInFlight, 0, nil)
+	go q.Start()
+	for i := 0; i < messages; i++ {
+		q.EnqueueMessage(fmt.Sprint(i), "Hello", []string{fmt.Sprintf("tel:9477100%04d", i)}, 0, false)
+	}
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Sent == messages })
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.maxInFlight > maxInFlight {
+		t.Errorf("got %d requests in flight, want at most %d", server.maxInFlight, maxInFlight)
+	}
+}
+
+func TestSMSQueueDeadLetter(t *testing.T) {
+	server := newSMSTestServer(1, 0)
+	defer server.Close()
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1}
+	q := NewSMSQueue(client, 10, 10, 2, nil)
+	go q.Start()
+	q.EnqueueMessage("1", "Hello", []string{"tel:94771000001"}, 0, false)
+	stats := waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.DeadLettered == 1 })
+	if stats.Retried != 2 || stats.Failed != 3 || stats.Sent != 0 {
+		t.Errorf("got %+v, want 2 retries and 3 failures", stats)
+	}
+}
+
+func TestSMSQueueDepthCountsBlockedMessages(t *testing.T) {
+	client := &SMSClient{SendEndpoint: "http://127.0.0.1:1", MaxAddressCount: 1}
+	q := NewSMSQueue(client, 1, 1, 0, nil)
+	for i := 0; i < 5; i++ {
+		q.EnqueueMessage(fmt.Sprint(i), "Hello", []string{"tel:94771000001", "tel:94771000002"}, 0, false)
+	}
+	stats := waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Depth == 10 })
+	if stats.Enqueued != stats.Depth {
+		t.Errorf("got depth %d, want the %d enqueued recipients", stats.Depth, stats.Enqueued)
+	}
+}
+
+func TestSMSQueueHeldBackMessagesDoNotUseRateLimit(t *testing.T) {
+	server := newSMSTestServer(0, 0)
+	defer server.Close()
+	now := time.Now().In(timestampLocation)
+	offset := now.Sub(localMidnight(now))
+	policy := &SMSSendPolicy{WindowStart: (offset + 2*time.Hour) % (24 * time.Hour), WindowEnd: (offset + 3*time.Hour) % (24 * time.Hour)}
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1, SendPolicy: policy}
+	q := NewSMSQueue(client, 100, 2, 0, nil)
+	go q.Start()
+	for i := 0; i < 10; i++ {
+		q.EnqueuePromotionalMessage(fmt.Sprint("p", i), "Offer", []string{"tel:94771000001"}, 0, false)
+	}
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Scheduled == 10 })
+	start := time.Now()
+	q.EnqueueMessage("t", "Receipt", []string{"tel:94771000002"}, 0, false)
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Sent == 1 })
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("transactional message took %v behind held back messages", d)
+	}
+	q.EnqueuePromotionalAt(time.Now(), "p", "Offer", []string{"tel:94771000003"}, 0, false)
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Scheduled == 11 })
+}
+
+// Submits a message to the queue and returns the results passed to its done hook, by recipient.
+func submitTestSMSMessage(q *SMSQueue, recipients ...string) <-chan map[string]error {
+	results := make(chan map[string]error, 1)
+	var lock sync.Mutex
+	errs := map[string]error{}
+	m := newSMSMessage("m", "Hello", recipients, 0, false, SMSCategoryTransactional)
+	m.done = func(recipient, smsMessageId string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs[recipient] = err
+		if len(errs) == len(recipients) {
+			results <- errs
+		}
+	}
+	q.submitMessage(m)
+	return results
+}
+
+func TestSMSQueueDoesNotRetryPermanentFailures(t *testing.T) {
+	server := newSMSTestServer(0, 0)
+	server.destinationStatus = ErrAddrFormatInvalid.Code
+	defer server.Close()
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1}
+	q := NewSMSQueue(client, 10, 10, 3, nil)
+	go q.Start()
+	results := submitTestSMSMessage(&q, "tel:94771000001")
+	stats := waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.DeadLettered == 1 })
+	if stats.Retried != 0 || stats.Failed != 1 || len(server.requestStarts()) != 1 {
+		t.Errorf("got %+v after %d requests, want one request and no retries", stats, len(server.requestStarts()))
+	}
+	if err := (<-results)["tel:94771000001"]; err != ErrAddrFormatInvalid {
+		t.Errorf("got error %v, want %v", err, ErrAddrFormatInvalid)
+	}
+}
+
+func TestSMSQueueRetriesForgottenPseudonyms(t *testing.T) {
+	server := newSMSTestServer(0, 0)
+	defer server.Close()
+	p := NewPseudonymizerWithMaxKnown([]byte("key"), 1)
+	id := p.Pseudonym("tel:94771000001")
+	// The first request fails, and the queue's pseudonym is forgotten before it is retried.
+	server.failEvery = 1
+	server.onRequest = func() {
+		server.failEvery = 0
+		p.Pseudonym("tel:94771000002")
+	}
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1, Pseudonymizer: p}
+	q := NewSMSQueue(client, 10, 10, 3, nil)
+	go q.Start()
+	results := submitTestSMSMessage(&q, id)
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Sent+s.DeadLettered == 1 })
+	if err, ok := (<-results)[id]; !ok || err != nil {
+		t.Errorf("got result %v for the pseudonym (reported: %v), want it sent", err, ok)
+	}
+}
+
+func TestSMSQueueCancelHeldBackMessage(t *testing.T) {
+	server := newSMSTestServer(0, 0)
+	defer server.Close()
+	now := time.Now().In(timestampLocation)
+	offset := now.Sub(localMidnight(now))
+	policy := &SMSSendPolicy{WindowStart: (offset + 2*time.Hour) % (24 * time.Hour), WindowEnd: (offset + 3*time.Hour) % (24 * time.Hour)}
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 1, SendPolicy: policy}
+	q := NewSMSQueue(client, 10, 10, 0, nil)
+	go q.Start()
+	m := newSMSMessage("p", "Offer", []string{"tel:94771000001"}, 0, false, SMSCategoryPromotional)
+	results := make(chan error, 1)
+	m.done = func(recipient, smsMessageId string, err error) { results <- err }
+	q.submitMessage(m)
+	waitForSMSQueue(t, &q, func(s SMSQueueStats) bool { return s.Scheduled == 1 })
+	if n := q.CancelScheduled("p"); n != 1 {
+		t.Errorf("cancelled %d messages, want 1", n)
+	}
+	if err := <-results; err != ErrMessageCancelled {
+		t.Errorf("got error %v, want %v", err, ErrMessageCancelled)
+	}
+	if stats := q.Stats(); stats.DeadLettered != 1 || stats.Scheduled != 0 {
+		t.Errorf("got %+v, want the recipient dead lettered", stats)
+	}
+}
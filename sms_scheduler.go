@@ -0,0 +1,192 @@
+package ideamart
+
+/*
+	Scheduler holding SMS queue messages until they are due for sending.
+*/
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type scheduledSMS struct {
+	message smsMessage
+	due     time.Time
+	queued  bool // Whether the message had already been enqueued before it was held back.
+	index   int
+}
+
+// Min-heap of scheduled messages ordered by due time.
+type scheduledSMSHeap []*scheduledSMS
+
+func (h scheduledSMSHeap) Len() int           { return len(h) }
+func (h scheduledSMSHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h scheduledSMSHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduledSMSHeap) Push(x interface{}) {
+	s := x.(*scheduledSMS)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *scheduledSMSHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	s.index = -1
+	return s
+}
+
+type smsScheduler struct {
+	lock    sync.Mutex
+	pending scheduledSMSHeap
+	byID    map[string][]*scheduledSMS
+	wake    chan struct{}
+}
+
+func newSMSScheduler() *smsScheduler {
+	return &smsScheduler{byID: map[string][]*scheduledSMS{}, wake: make(chan struct{}, 1)}
+}
+
+func (s *smsScheduler) schedule(m smsMessage, due time.Time) {
+	s.add(&scheduledSMS{message: m, due: due.In(timestampLocation)})
+}
+
+// Holds back a message which has already been enqueued until it is due again.
+func (s *smsScheduler) holdBack(m smsMessage, due time.Time) {
+	s.add(&scheduledSMS{message: m, due: due.In(timestampLocation), queued: true})
+}
+
+func (s *smsScheduler) add(e *scheduledSMS) {
+	s.lock.Lock()
+	m := e.message
+	heap.Push(&s.pending, e)
+	s.byID[m.ID] = append(s.byID[m.ID], e)
+	s.lock.Unlock()
+	s.notify()
+}
+
+func (s *smsScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Removes the messages with the given id, and returns them.
+func (s *smsScheduler) cancel(id string) []*scheduledSMS {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries := s.byID[id]
+	for _, e := range entries {
+		heap.Remove(&s.pending, e.index)
+	}
+	delete(s.byID, id)
+	return entries
+}
+
+func (s *smsScheduler) size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending)
+}
+
+// Removes and returns the messages that are due, and the time until the next one is due.
+// The returned duration is negative if nothing else is scheduled.
+func (s *smsScheduler) popDue(now time.Time) ([]*scheduledSMS, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	due := []*scheduledSMS{}
+	for len(s.pending) > 0 && !s.pending[0].due.After(now) {
+		e := heap.Pop(&s.pending).(*scheduledSMS)
+		s.forget(e)
+		due = append(due, e)
+	}
+	if len(s.pending) == 0 {
+		return due, -1
+	}
+	return due, s.pending[0].due.Sub(now)
+}
+
+func (s *smsScheduler) forget(e *scheduledSMS) {
+	entries := s.byID[e.message.ID]
+	for i := range entries {
+		if entries[i] == e {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(s.byID, e.message.ID)
+	} else {
+		s.byID[e.message.ID] = entries
+	}
+}
+
+// Releases messages as they become due. New messages are passed to submit, and messages
+// which had been held back after being enqueued are passed to requeue. Never returns.
+func (s *smsScheduler) run(submit, requeue func(smsMessage)) {
+	for {
+		due, wait := s.popDue(time.Now())
+		for _, e := range due {
+			if e.queued {
+				requeue(e.message)
+			} else {
+				submit(e.message)
+			}
+		}
+		if wait < 0 {
+			<-s.wake
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// Schedules a transactional message to be enqueued in the SMS queue at the given time.
+// The time is evaluated in Sri Lankan time (Asia/Colombo), so times built with time.Date should use that location.
+// Messages which are already due are enqueued as soon as the queue is started.
+func (q *SMSQueue) EnqueueAt(at time.Time, id, message string, recipients []string, chargingAmount float32, reportDelivery bool) {
+	q.scheduler.schedule(newSMSMessage(id, message, recipients, chargingAmount, reportDelivery, SMSCategoryTransactional), at)
+}
+
+// Schedules a promotional message to be enqueued in the SMS queue at the given time.
+// If the client's send policy does not allow sending it then, it is held back until the next allowed window.
+func (q *SMSQueue) EnqueuePromotionalAt(at time.Time, id, message string, recipients []string, chargingAmount float32, reportDelivery bool) {
+	q.scheduler.schedule(newSMSMessage(id, message, recipients, chargingAmount, reportDelivery, SMSCategoryPromotional), at)
+}
+
+// Schedules a message to be enqueued in the SMS queue after the given delay.
+func (q *SMSQueue) EnqueueAfter(delay time.Duration, id, message string, recipients []string, chargingAmount float32, reportDelivery bool) {
+	q.EnqueueAt(time.Now().Add(delay), id, message, recipients, chargingAmount, reportDelivery)
+}
+
+// Cancels all scheduled messages with the given id, including promotional messages being held back until the send
+// policy allows them. Held back messages have already been enqueued, so their recipients are counted as dead lettered
+// and given up on with ErrMessageCancelled. Returns the number of messages cancelled.
+func (q *SMSQueue) CancelScheduled(id string) int {
+	entries := q.scheduler.cancel(id)
+	for _, e := range entries {
+		if !e.queued {
+			continue
+		}
+		q.counters.deadLettered.Add(int64(len(e.message.recipients)))
+		if e.message.done != nil {
+			for _, r := range e.message.recipients {
+				e.message.done(q.client.Pseudonymizer.Pseudonym(r), "", ErrMessageCancelled)
+			}
+		}
+	}
+	return len(entries)
+}
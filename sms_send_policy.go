@@ -0,0 +1,54 @@
+package ideamart
+
+/*
+	Send window policy for outgoing SMS messages.
+	Promotional messages may only be sent within a daily window, transactional messages are never restricted.
+*/
+
+import "time"
+
+type SMSCategory string
+
+// SMS message categories
+const (
+	SMSCategoryTransactional SMSCategory = "transactional"
+	SMSCategoryPromotional   SMSCategory = "promotional"
+)
+
+// Daily window during which promotional messages may be sent.
+// WindowStart and WindowEnd are offsets from midnight in Sri Lankan time (Asia/Colombo),
+// e.g. 8 * time.Hour for 08:00. A window ending before it starts wraps past midnight.
+// A window which starts and ends at the same time does not restrict anything.
+type SMSSendPolicy struct {
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+}
+
+func localMidnight(t time.Time) time.Time {
+	y, m, d := t.In(timestampLocation).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, timestampLocation)
+}
+
+// Reports whether a message of the given category may be sent at time t. A nil policy allows everything.
+func (p *SMSSendPolicy) Allows(category SMSCategory, t time.Time) bool {
+	if p == nil || category != SMSCategoryPromotional || p.WindowStart == p.WindowEnd {
+		return true
+	}
+	offset := t.Sub(localMidnight(t))
+	if p.WindowStart < p.WindowEnd {
+		return offset >= p.WindowStart && offset < p.WindowEnd
+	}
+	return offset >= p.WindowStart || offset < p.WindowEnd
+}
+
+// Returns the earliest time at or after t when a message of the given category may be sent.
+func (p *SMSSendPolicy) NextAllowed(category SMSCategory, t time.Time) time.Time {
+	if p.Allows(category, t) {
+		return t
+	}
+	midnight := localMidnight(t)
+	if t.Sub(midnight) < p.WindowStart {
+		return midnight.Add(p.WindowStart)
+	}
+	return midnight.AddDate(0, 0, 1).Add(p.WindowStart)
+}
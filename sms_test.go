@@ -0,0 +1,23 @@
+package ideamart
+
+import "testing"
+
+func TestSendTextMessageReportsInvalidAddresses(t *testing.T) {
+	server := newSMSTestServer(0, 0)
+	defer server.Close()
+	client := &SMSClient{SendEndpoint: server.URL, MaxAddressCount: 10, RetryCount: 1}
+	destResps, failures, err := client.SendTextMessage("Hello", []string{"12345"}, 0, false)
+	if err != ErrAddrFormatInvalid || len(failures) != 1 {
+		t.Errorf("got error %v and failures %v, want %v for the one recipient", err, failures, ErrAddrFormatInvalid)
+	}
+	if len(destResps) != 1 || destResps[0].Error == nil || *destResps[0].Error != ErrAddrFormatInvalid {
+		t.Errorf("got destination responses %+v, want one with error %v", destResps, ErrAddrFormatInvalid)
+	}
+	destResps, failures, err = client.SendTextMessage("Hello", []string{"12345", "0771000001"}, 0, false)
+	if err != nil || len(failures) != 1 || len(destResps) != 2 || !destResps[1].Sent {
+		t.Errorf("got error %v, failures %v and responses %+v, want the valid address sent", err, failures, destResps)
+	}
+	if n := len(server.requestStarts()); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
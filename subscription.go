@@ -22,6 +22,8 @@ const (
 
 // The Subscription service client.
 // SubscriptionStatusCallback is called to handle Subscription notifications.
+// If SuppressionList is set, subscribers who unsubscribe are added to it and removed again when they resubscribe.
+// If Pseudonymizer is set, the callback receives pseudonyms instead of subscriber IDs, which can be used in their place.
 type SubscriptionClient struct {
 	ApplicationID              string
 	Password                   string
@@ -29,6 +31,8 @@ type SubscriptionClient struct {
 	StatusQueryEndpoint        string
 	BaseSizeEndpoint           string
 	SubscriptionStatusCallback func(subscriberId, status string, timestamp time.Time)
+	SuppressionList            *SuppressionList
+	Pseudonymizer              *Pseudonymizer
 }
 
 type SubscriptionRequest struct {
@@ -90,15 +94,19 @@ func parseSubscriptionTimestamp(value string) time.Time {
 }
 
 func (client *SubscriptionClient) sendSubscriptionRequest(subscriberId, action string) (string, error) {
+	addr, err := ParseAddress(client.Pseudonymizer.resolve(subscriberId))
+	if err != nil {
+		return "", err
+	}
 	req := SubscriptionRequest{
 		ApplicationID: client.ApplicationID,
 		Password:      client.Password,
-		SubscriberID:  subscriberId,
+		SubscriberID:  addr.String(),
 		Version:       version,
 		Action:        action,
 	}
 	res := SubscriptionResponse{}
-	err := doRequest(client.SubscriptionEndpoint, req, &res)
+	err = doRequest(client.SubscriptionEndpoint, req, &res)
 	if err != nil {
 		return "", err
 	}
@@ -128,28 +136,48 @@ func (client *SubscriptionClient) GetBaseSize() (int, error) {
 }
 
 func (client *SubscriptionClient) GetStatus(subscriberId string) (string, error) {
+	addr, err := ParseAddress(client.Pseudonymizer.resolve(subscriberId))
+	if err != nil {
+		return "", err
+	}
 	req := SubscriptionStatusRequest{
 		ApplicationID: client.ApplicationID,
 		Password:      client.Password,
-		SubscriberID:  subscriberId,
+		SubscriberID:  addr.String(),
 	}
 	res := SubscriptionStatusResponse{}
-	err := doRequest(client.StatusQueryEndpoint, req, &res)
+	err = doRequest(client.StatusQueryEndpoint, req, &res)
 	if err != nil {
 		return "", err
 	}
 	return res.SubscriptionStatus, nil
 }
 
+func (client *SubscriptionClient) updateSuppressionList(subscriberId, status string) {
+	if client.SuppressionList == nil {
+		return
+	}
+	switch status {
+	case SubscriberStatusUnregistered:
+		client.SuppressionList.Add(subscriberId, SuppressionReasonUnsubscribed)
+	case SubscriberStatusRegistered:
+		if e := client.SuppressionList.Get(subscriberId); e != nil && e.Reason == SuppressionReasonUnsubscribed {
+			client.SuppressionList.Remove(subscriberId)
+		}
+	}
+}
+
 // This method should be attached as the subscription notification endpoint handler.
 func (client *SubscriptionClient) HandleSubscriptionNotification(res http.ResponseWriter, req *http.Request) {
 	notification := SubscriptionNotification{}
-	err := unmarshalRequest(req, &notification)
+	err := unmarshalRequest(req, &notification, client.Pseudonymizer == nil)
 	if err != nil {
 		sendErrorResponse(res)
 	} else {
 		sendSuccessResponse(res)
 	}
 	req.Body.Close()
-	go client.SubscriptionStatusCallback(subscriptionIDPrefix+notification.SubscriberID, notification.Status, parseSubscriptionTimestamp(notification.Timestamp))
+	subscriberId := canonicalAddress(subscriptionIDPrefix + notification.SubscriberID)
+	client.updateSuppressionList(subscriberId, notification.Status)
+	go client.SubscriptionStatusCallback(client.Pseudonymizer.Pseudonym(subscriberId), notification.Status, parseSubscriptionTimestamp(notification.Timestamp))
 }
@@ -0,0 +1,146 @@
+package ideamart
+
+/*
+	Suppression list of subscribers who must not be sent any more messages.
+*/
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Suppression reasons
+const (
+	SuppressionReasonBlacklisted    = "BLACKLISTED"
+	SuppressionReasonNotWhitelisted = "NOT_WHITELISTED"
+	SuppressionReasonUnsubscribed   = "UNSUBSCRIBED"
+	SuppressionReasonManual         = "MANUAL"
+)
+
+type SuppressionEntry struct {
+	Address   string
+	Reason    string
+	Timestamp time.Time
+}
+
+// A list of addresses that messages should not be sent to.
+// It can be shared by SMS and subscription clients, which add to it automatically when Ideamart reports that an
+// address is black listed or not white listed, or when a subscriber unsubscribes. A nil list suppresses nothing.
+// Addresses are normalised to the tel: form, so any of the forms accepted by ParseAddress can be used.
+type SuppressionList struct {
+	lock    sync.RWMutex
+	entries map[string]SuppressionEntry
+}
+
+// Returns a new, empty suppression list.
+func NewSuppressionList() *SuppressionList {
+	return &SuppressionList{entries: map[string]SuppressionEntry{}}
+}
+
+// Adds an address to the list, replacing any existing entry for it. Does nothing on a nil list.
+func (l *SuppressionList) Add(address, reason string) {
+	if l == nil {
+		return
+	}
+	address = canonicalAddress(address)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries[address] = SuppressionEntry{address, reason, time.Now().In(timestampLocation)}
+}
+
+// Removes an address from the list. Returns false if it was not on the list.
+func (l *SuppressionList) Remove(address string) bool {
+	if l == nil {
+		return false
+	}
+	address = canonicalAddress(address)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, ok := l.entries[address]
+	delete(l.entries, address)
+	return ok
+}
+
+// Reports whether an address is on the list.
+func (l *SuppressionList) Contains(address string) bool {
+	if l == nil {
+		return false
+	}
+	address = canonicalAddress(address)
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.entries[address]
+	return ok
+}
+
+// Returns the entry for an address, or nil if it is not on the list.
+func (l *SuppressionList) Get(address string) *SuppressionEntry {
+	if l == nil {
+		return nil
+	}
+	address = canonicalAddress(address)
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if e, ok := l.entries[address]; ok {
+		return &e
+	}
+	return nil
+}
+
+// Returns all entries ordered by address.
+func (l *SuppressionList) Entries() []SuppressionEntry {
+	if l == nil {
+		return []SuppressionEntry{}
+	}
+	l.lock.RLock()
+	entries := make([]SuppressionEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	l.lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Address < entries[j].Address })
+	return entries
+}
+
+// Writes all entries as CSV with the columns address, reason and timestamp (RFC 3339).
+func (l *SuppressionList) Export(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"address", "reason", "timestamp"})
+	for _, e := range l.Entries() {
+		writer.Write([]string{e.Address, e.Reason, e.Timestamp.Format(time.RFC3339)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Splits addresses into those that may be sent to and those on the list.
+func (l *SuppressionList) filter(addresses []string) (allowed, suppressed []string) {
+	if l == nil {
+		return addresses, nil
+	}
+	allowed = make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if l.Contains(a) {
+			suppressed = append(suppressed, a)
+		} else {
+			allowed = append(allowed, a)
+		}
+	}
+	return allowed, suppressed
+}
+
+// Adds the address if the error shows that it can never be sent to.
+func (l *SuppressionList) learn(address string, err error) {
+	if l == nil {
+		return
+	}
+	switch err {
+	case ErrMSISDNBlacklisted:
+		l.Add(address, SuppressionReasonBlacklisted)
+	case ErrMSISDNNotWhitelisted:
+		l.Add(address, SuppressionReasonNotWhitelisted)
+	}
+}
@@ -0,0 +1,192 @@
+package ideamart
+
+/*
+	Localised message templates for SMS and USSD.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode/utf16"
+)
+
+type Locale string
+
+// Locales
+const (
+	LocaleEnglish Locale = "en"
+	LocaleSinhala Locale = "si"
+	LocaleTamil   Locale = "ta"
+)
+
+// Message length limits.
+// Messages which only use the GSM 7-bit alphabet fit more characters than those needing Unicode (UCS-2),
+// such as Sinhala and Tamil text. Concatenated SMS segments lose some space to the concatenation header.
+const (
+	USSDMaxLength        = 182
+	USSDMaxLengthUnicode = 80
+
+	smsSegmentLength              = 160
+	smsConcatSegmentLength        = 153
+	smsSegmentLengthUnicode       = 70
+	smsConcatSegmentLengthUnicode = 67
+)
+
+const (
+	gsmBasicCharset    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsmExtendedCharset = "^{}\\[~]|€\f"
+)
+
+// Returns the length of the message in GSM 7-bit septets, or -1 if it cannot be encoded in the GSM alphabet.
+func gsmLength(message string) int {
+	length := 0
+	for _, c := range message {
+		switch {
+		case strings.ContainsRune(gsmBasicCharset, c):
+			length++
+		case strings.ContainsRune(gsmExtendedCharset, c):
+			length += 2
+		default:
+			return -1
+		}
+	}
+	return length
+}
+
+// Returns the number of SMS segments needed to send the message.
+func SMSSegmentCount(message string) int {
+	length, single, concat := gsmLength(message), smsSegmentLength, smsConcatSegmentLength
+	if length < 0 {
+		length, single, concat = ucs2Length(message), smsSegmentLengthUnicode, smsConcatSegmentLengthUnicode
+	}
+	if length <= single {
+		return 1
+	}
+	return (length + concat - 1) / concat
+}
+
+// Reports whether the message fits on a single USSD screen.
+func USSDMessageFits(message string) bool {
+	if length := gsmLength(message); length >= 0 {
+		return length <= USSDMaxLength
+	}
+	return ucs2Length(message) <= USSDMaxLengthUnicode
+}
+
+// Returns the length of the message in UTF-16 code units.
+func ucs2Length(message string) int {
+	return len(utf16.Encode([]rune(message)))
+}
+
+// A registry of named message templates with a variant per locale.
+// Templates use text/template syntax. When rendering for a subscriber, their preferred locale is taken from the
+// preferences set with SetLocale, then from LocaleLookup if set, and finally DefaultLocale is used.
+// A template missing in the chosen locale falls back to the DefaultLocale variant.
+type TemplateRegistry struct {
+	DefaultLocale Locale
+	LocaleLookup  func(address string) (Locale, bool)
+
+	lock        sync.RWMutex
+	templates   map[string]map[Locale]*template.Template
+	preferences map[string]Locale
+}
+
+// Returns a new, empty template registry.
+func NewTemplateRegistry(defaultLocale Locale) *TemplateRegistry {
+	return &TemplateRegistry{
+		DefaultLocale: defaultLocale,
+		templates:     map[string]map[Locale]*template.Template{},
+		preferences:   map[string]Locale{},
+	}
+}
+
+// Parses and registers the locale variant of a named template, replacing any existing one.
+func (r *TemplateRegistry) Register(name string, locale Locale, text string) error {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.templates[name] == nil {
+		r.templates[name] = map[Locale]*template.Template{}
+	}
+	r.templates[name][locale] = t
+	return nil
+}
+
+// Sets the preferred locale of a subscriber.
+func (r *TemplateRegistry) SetLocale(address string, locale Locale) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.preferences[canonicalAddress(address)] = locale
+}
+
+// Returns the preferred locale of a subscriber.
+func (r *TemplateRegistry) Locale(address string) Locale {
+	r.lock.RLock()
+	locale, ok := r.preferences[canonicalAddress(address)]
+	r.lock.RUnlock()
+	if ok {
+		return locale
+	}
+	if r.LocaleLookup != nil {
+		if locale, ok := r.LocaleLookup(address); ok {
+			return locale
+		}
+	}
+	return r.DefaultLocale
+}
+
+// Renders the locale variant of a named template with the given data.
+func (r *TemplateRegistry) Render(name string, locale Locale, data interface{}) (string, error) {
+	r.lock.RLock()
+	variants := r.templates[name]
+	t := variants[locale]
+	if t == nil {
+		t = variants[r.DefaultLocale]
+	}
+	r.lock.RUnlock()
+	if t == nil {
+		return "", fmt.Errorf("template %q is not registered for locale %q", name, locale)
+	}
+	message := bytes.Buffer{}
+	if err := t.Execute(&message, data); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// Renders a named template in the preferred locale of the subscriber.
+func (r *TemplateRegistry) RenderFor(name, address string, data interface{}) (string, error) {
+	return r.Render(name, r.Locale(address), data)
+}
+
+// Renders an SMS message for the subscriber.
+// Returns ErrSMSMsgTooLong if the message would need more than maxSegments SMS segments.
+func (r *TemplateRegistry) RenderSMS(name, address string, data interface{}, maxSegments int) (string, error) {
+	message, err := r.RenderFor(name, address, data)
+	if err != nil {
+		return "", err
+	}
+	if SMSSegmentCount(message) > maxSegments {
+		return message, ErrSMSMsgTooLong
+	}
+	return message, nil
+}
+
+// Renders a USSD message for the subscriber.
+// Returns ErrUSSDMsgTooLong if the message does not fit on a single USSD screen.
+func (r *TemplateRegistry) RenderUSSD(name, address string, data interface{}) (string, error) {
+	message, err := r.RenderFor(name, address, data)
+	if err != nil {
+		return "", err
+	}
+	if !USSDMessageFits(message) {
+		return message, ErrUSSDMsgTooLong
+	}
+	return message, nil
+}
@@ -1,8 +1,11 @@
 package ideamart
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"runtime/debug"
 	"time"
 )
 
@@ -18,6 +21,14 @@ const (
 	MobileOriginatedContinue MobileOriginatedUSSDOperation = "mo-cont"
 
 	statusCodeSuccess string = "S1000"
+
+	// Sent to the subscriber when the message handler fails, unless the client sets another text.
+	DefaultUSSDFailureText = "Service temporarily unavailable. Please try again later."
+
+	// How long after a message arrives its response may still be sent. The network abandons the session after this.
+	ussdResponseTimeout = 10 * time.Second
+	// Wait before the first retry of a response, doubled for every further retry.
+	ussdRetryInterval = 250 * time.Millisecond
 )
 
 type USSDMobileTerminatedRequest struct {
@@ -56,15 +67,40 @@ type USSDSessionStore interface {
 // The USSD client.
 // SessionStore should implement the interface USSDSessionStore.
 // The provided inMemorySessionStore can be used for this.
+// Alternatively SessionStoreV2 can be set to a store implementing USSDSessionStoreV2, in which case it is used instead.
+// Sessions are saved after every message, and deleted once a final response is sent.
 // IncomingMessageHandlerFunc is called to get the response to a USSD message.
+// The dial string which started a session is parsed and kept in the session data under USSDDialStringKey.
+// If Pseudonymizer is set, the handler receives a pseudonym instead of the subscriber's address.
+// If Pagination is set, responses too long for a single screen are split into pages.
+// If the handler returns an error or panics, the session is ended with FailureText, or DefaultUSSDFailureText if that
+// is empty, and HandlerFailureCallbackFunc is called with the error if it is set.
+// Sending a response is tried up to RetryCount times while the session lasts, retrying transport failures and
+// retryable API errors. If it still fails the session is deleted and DeliveryFailureCallbackFunc is called if it is set.
+// OnSessionStart, OnSessionEnd and OnSessionTimeout are called as sessions start and end, if they are set.
+// Pass SessionEvicted to the session store's SetEvictionCallback for them to cover sessions the store discards.
+// If Analytics is set, the path of every session through the menu is recorded in it.
 type USSDClient struct {
-	ApplicationID              string
-	Password                   string
-	SendEndpoint               string
-	RetryCount                 int
-	SessionStore               USSDSessionStore
-	IncomingMessageHandlerFunc func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (response string, responseType MobileTerminatedUSSDOperation, err error)
-	LogRequestDuration         bool
+	ApplicationID               string
+	Password                    string
+	SendEndpoint                string
+	RetryCount                  int
+	SessionStore                USSDSessionStore
+	SessionStoreV2              USSDSessionStoreV2
+	IncomingMessageHandlerFunc  func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (response string, responseType MobileTerminatedUSSDOperation, err error)
+	LogRequestDuration          bool
+	Pseudonymizer               *Pseudonymizer
+	Pagination                  *USSDPagination
+	FailureText                 string
+	HandlerFailureCallbackFunc  func(sessionID, address string, err error)
+	DeliveryFailureCallbackFunc func(sessionID, address string, err error)
+	OnSessionStart              func(session USSDSession)
+	OnSessionEnd                func(session USSDSession, reason string)
+	OnSessionTimeout            func(session USSDSession)
+	Analytics                   *USSDAnalytics
+	sequencer                   ussdSessionSequencer
+	// Replaces sending responses to SendEndpoint when set, for USSDTestHarness.
+	sendFunc func(request USSDMobileTerminatedRequest) error
 }
 
 type USSDSession struct {
@@ -81,28 +117,147 @@ func newUSSDSession(id, remoteAddr string) USSDSession {
 	}
 }
 
+// Sends a response, retrying transport failures and retryable API errors until retryCount attempts have been made
+// or the next attempt would be after the deadline. At least one attempt is made.
+func (request *USSDMobileTerminatedRequest) sendWithRetries(endpoint string, retryCount int, deadline time.Time) error {
+	interval := ussdRetryInterval
+	for c := 0; c == 0 || c < retryCount; c++ {
+		if c > 0 {
+			if time.Now().Add(interval).After(deadline) {
+				break
+			}
+			time.Sleep(interval)
+			interval *= 2
+		}
+		resp := USSDMobileTerminatedResponse{}
+		if err := doRequest(endpoint, *request, &resp); err != nil {
+			log.Print(err)
+			continue
+		}
+		if isSuccessCode(resp.StatusCode) {
+			return nil
+		}
+		apiErr := apiErrorFromCode(resp.StatusCode)
+		log.Print(apiErr, resp)
+		if !apiErr.Retryable {
+			return apiErr
+		}
+	}
+	return ErrSendingFailed
+}
+
+// Sends a request to the subscriber before the deadline.
+func (client *USSDClient) send(request USSDMobileTerminatedRequest, deadline time.Time) error {
+	if client.sendFunc != nil {
+		return client.sendFunc(request)
+	}
+	return request.sendWithRetries(client.SendEndpoint, client.RetryCount, deadline)
+}
+
+// Calls the message handler, turning a panic into an error.
+func (client *USSDClient) callHandler(address string, ussdReq USSDMobileOriginatedRequest, sessionData map[string]interface{}) (response string, responseType MobileTerminatedUSSDOperation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("USSD message handler panicked: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("USSD message handler panicked: %v", r)
+		}
+	}()
+	return client.IncomingMessageHandlerFunc(address, ussdReq.Message, ussdReq.USSDOperation, sessionData)
+}
+
+// Gets the response to an incoming message, from the pagination of an earlier response or the message handler.
+// If the handler fails, the response is the failure text, which ends the session, and the handler's error is returned.
+func (client *USSDClient) respond(session *USSDSession, ussdReq USSDMobileOriginatedRequest) (string, MobileTerminatedUSSDOperation, error) {
+	if client.Pagination != nil && ussdReq.USSDOperation == MobileOriginatedContinue {
+		if response, responseType, ok := client.Pagination.navigate(session.SessionData, ussdReq.Message); ok {
+			return response, responseType, nil
+		}
+	}
+	address := client.Pseudonymizer.Pseudonym(session.RemoteAddress)
+	response, responseType, err := client.callHandler(address, ussdReq, session.SessionData)
+	if err != nil {
+		log.Print("Error handling incoming USSD message: ", err)
+		if client.HandlerFailureCallbackFunc != nil {
+			client.HandlerFailureCallbackFunc(session.ID, address, err)
+		}
+		if client.FailureText != "" {
+			return client.FailureText, MobileTermiatedFinal, err
+		}
+		return DefaultUSSDFailureText, MobileTermiatedFinal, err
+	}
+	if client.Pagination != nil {
+		response, responseType = client.Pagination.start(session.SessionData, response, responseType)
+	}
+	return response, responseType, nil
+}
+
+func (client *USSDClient) sessionStore() USSDSessionStoreV2 {
+	if client.SessionStoreV2 != nil {
+		return client.SessionStoreV2
+	}
+	return AdaptUSSDSessionStore(client.SessionStore)
+}
+
+// Saves the session after a response, or deletes it if the response ends it.
+func (client *USSDClient) storeSession(session *USSDSession, responseType MobileTerminatedUSSDOperation) {
+	ctx, cancel := context.WithTimeout(context.Background(), ussdSessionStoreTimeout)
+	defer cancel()
+	var err error
+	if responseType == MobileTermiatedFinal {
+		err = client.sessionStore().Delete(ctx, session.ID)
+	} else {
+		err = client.sessionStore().Save(ctx, *session)
+	}
+	if err != nil {
+		log.Print("Error storing USSD session: ", err)
+	}
+}
+
 // This method should be attached as the handler to the USSD receiving endpoint of the server.
+// Messages for a session are processed one at a time in the order they arrive, while different sessions are
+// processed concurrently.
 func (client *USSDClient) HandleIncoming(res http.ResponseWriter, req *http.Request) {
 	tBegin := time.Now()
 	ussdReq := USSDMobileOriginatedRequest{}
-	err := unmarshalRequest(req, &ussdReq)
+	err := unmarshalRequest(req, &ussdReq, client.Pseudonymizer == nil)
+	req.Body.Close()
 	var session *USSDSession
-	if ussdReq.USSDOperation == MobileOriginatedInitial {
-		s := newUSSDSession(ussdReq.SessionID, ussdReq.SourceAddress)
-		client.SessionStore.Save(s)
-		session = client.SessionStore.Get(ussdReq.SessionID)
-	} else {
-		session = client.SessionStore.Get(ussdReq.SessionID)
+	if err == nil {
+		store := client.sessionStore()
+		if ussdReq.USSDOperation == MobileOriginatedInitial {
+			s := newUSSDSession(ussdReq.SessionID, canonicalAddress(ussdReq.SourceAddress))
+			if dial, err := ParseUSSDDialString(ussdReq.Message); err == nil {
+				USSDDialStringKey.Set(s.SessionData, dial)
+			}
+			err = store.Save(req.Context(), s)
+			session = &s
+		} else {
+			// The session is loaded when the message is processed, as earlier messages may still change it.
+			err = store.Touch(req.Context(), ussdReq.SessionID)
+		}
 	}
-	if err != nil || session == nil {
+	if err != nil {
+		log.Print("Error handling incoming USSD message: ", err)
 		sendErrorResponse(res)
 		return
-	} else {
-		sendSuccessResponse(res)
 	}
-	req.Body.Close()
-	go func() {
-		response, responseType, err := client.IncomingMessageHandlerFunc(session.RemoteAddress, ussdReq.Message, ussdReq.USSDOperation, session.SessionData)
+	sendSuccessResponse(res)
+	client.sequencer.run(ussdReq.SessionID, func() {
+		if session == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), ussdSessionStoreTimeout)
+			session, err = client.sessionStore().Get(ctx, ussdReq.SessionID)
+			cancel()
+			if err != nil {
+				log.Print("Error handling incoming USSD message: ", err)
+				return
+			}
+		}
+		if ussdReq.USSDOperation == MobileOriginatedInitial {
+			client.sessionStarted(*session)
+		}
+		response, responseType, handlerErr := client.respond(session, ussdReq)
+		client.Analytics.visit(session.SessionData, ussdReq.Message)
+		client.storeSession(session, responseType)
 		ussdResp := USSDMobileTerminatedRequest{
 			ApplicationID:      client.ApplicationID,
 			Password:           client.Password,
@@ -114,16 +269,25 @@ func (client *USSDClient) HandleIncoming(res http.ResponseWriter, req *http.Requ
 		if client.LogRequestDuration {
 			log.Printf("Request processing duration: %v\n", time.Since(tBegin))
 		}
-		resp := USSDMobileTerminatedResponse{}
-		err = doRequest(client.SendEndpoint, ussdResp, &resp)
-		if err != nil {
-			log.Print(err)
-		}
+		err = client.send(ussdResp, tBegin.Add(ussdResponseTimeout))
 		if client.LogRequestDuration {
 			log.Printf("Request duration: %v\n", time.Since(tBegin))
 		}
-		if resp.StatusCode != statusCodeSuccess {
-			log.Print(apiErrorFromCode(resp.StatusCode), resp)
+		switch {
+		case err != nil:
+			log.Print("Error sending USSD response: ", err)
+			// The subscriber never sees the response, so the session cannot continue.
+			if responseType != MobileTermiatedFinal {
+				client.storeSession(session, MobileTermiatedFinal)
+			}
+			if client.DeliveryFailureCallbackFunc != nil {
+				client.DeliveryFailureCallbackFunc(session.ID, client.Pseudonymizer.Pseudonym(session.RemoteAddress), err)
+			}
+			client.sessionEnded(*session, USSDSessionEndUndelivered)
+		case handlerErr != nil:
+			client.sessionEnded(*session, USSDSessionEndFailed)
+		case responseType == MobileTermiatedFinal:
+			client.sessionEnded(*session, USSDSessionEndCompleted)
 		}
-	}()
+	})
 }
@@ -0,0 +1,188 @@
+package ideamart
+
+/*
+	Funnel analytics for USSD menus, recording the path of every session through the menu nodes.
+*/
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ussdAnalyticsPathKey = "ideamart.analytics.path"
+
+func init() {
+	RegisterUSSDSessionType([]USSDPathStep{})
+}
+
+// A message in a session, and the menu node shown in response to it.
+// Node is empty if the message handler is not a USSDMenu. Input is only recorded if the analytics records inputs.
+type USSDPathStep struct {
+	Node  string    `json:"node"`
+	Input string    `json:"input,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// The path of an ended session through the menu, and how it ended.
+// Address is pseudonymised if the client has a Pseudonymizer.
+type USSDSessionPath struct {
+	SessionID string         `json:"sessionId"`
+	Address   string         `json:"address"`
+	Steps     []USSDPathStep `json:"steps"`
+	EndReason string         `json:"endReason"`
+	End       time.Time      `json:"end"`
+}
+
+// How sessions went through a menu node.
+// Visits counts every time the node was shown, and Sessions the sessions which reached it at least once.
+// Completions and DropOffs count the sessions which ended at the node, normally or otherwise.
+type USSDNodeStats struct {
+	Node        string `json:"node"`
+	Visits      int    `json:"visits"`
+	Sessions    int    `json:"sessions"`
+	Completions int    `json:"completions"`
+	DropOffs    int    `json:"dropOffs"`
+}
+
+// Records the paths of USSD sessions through menus and aggregates them into per node funnel statistics.
+// Set it as the Analytics of a USSDClient. The path of a session is kept in its session data while it lasts, so it is
+// recorded however many servers share the session store, and aggregated here when the session ends.
+// For sessions which time out to be counted, set the client's SessionEvicted as the store's eviction callback.
+// The last MaxPaths session paths are kept for export. Inputs are only recorded if RecordInputs is set, as they may
+// contain PINs or personal information.
+type USSDAnalytics struct {
+	MaxPaths     int
+	RecordInputs bool
+	lock         sync.Mutex
+	paths        []USSDSessionPath
+	nodes        map[string]*USSDNodeStats
+}
+
+// Returns analytics keeping the last maxPaths session paths.
+func NewUSSDAnalytics(maxPaths int) *USSDAnalytics {
+	return &USSDAnalytics{MaxPaths: maxPaths, nodes: map[string]*USSDNodeStats{}}
+}
+
+// Records a message of a session, after the response to it has been made. Does nothing if a is nil.
+func (a *USSDAnalytics) visit(sessionData map[string]interface{}, input string) {
+	if a == nil {
+		return
+	}
+	step := USSDPathStep{Time: time.Now().In(timestampLocation)}
+	step.Node, _ = sessionData[ussdMenuNodeKey].(string)
+	if a.RecordInputs {
+		step.Input = input
+	}
+	path, _ := sessionData[ussdAnalyticsPathKey].([]USSDPathStep)
+	sessionData[ussdAnalyticsPathKey] = append(path, step)
+}
+
+// Records the end of a session. Does nothing if a is nil.
+func (a *USSDAnalytics) end(session USSDSession, reason string) {
+	if a == nil {
+		return
+	}
+	steps, _ := session.SessionData[ussdAnalyticsPathKey].([]USSDPathStep)
+	path := USSDSessionPath{session.ID, session.RemoteAddress, steps, reason, time.Now().In(timestampLocation)}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	reached := map[string]bool{}
+	for _, step := range steps {
+		stats := a.node(step.Node)
+		stats.Visits++
+		if !reached[step.Node] {
+			reached[step.Node] = true
+			stats.Sessions++
+		}
+	}
+	if len(steps) > 0 {
+		last := a.node(steps[len(steps)-1].Node)
+		if reason == USSDSessionEndCompleted {
+			last.Completions++
+		} else {
+			last.DropOffs++
+		}
+	}
+	if a.MaxPaths > 0 {
+		if len(a.paths) >= a.MaxPaths {
+			a.paths = append(a.paths[:0], a.paths[len(a.paths)-a.MaxPaths+1:]...)
+		}
+		a.paths = append(a.paths, path)
+	}
+}
+
+// Returns the statistics of a node, creating them if needed. The lock must be held.
+func (a *USSDAnalytics) node(id string) *USSDNodeStats {
+	if a.nodes == nil {
+		a.nodes = map[string]*USSDNodeStats{}
+	}
+	stats := a.nodes[id]
+	if stats == nil {
+		stats = &USSDNodeStats{Node: id}
+		a.nodes[id] = stats
+	}
+	return stats
+}
+
+// Returns the recorded paths of ended sessions, oldest first.
+func (a *USSDAnalytics) Paths() []USSDSessionPath {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]USSDSessionPath{}, a.paths...)
+}
+
+// Returns the statistics of every node reached by an ended session, the most reached first.
+func (a *USSDAnalytics) Funnel() []USSDNodeStats {
+	a.lock.Lock()
+	funnel := make([]USSDNodeStats, 0, len(a.nodes))
+	for _, stats := range a.nodes {
+		funnel = append(funnel, *stats)
+	}
+	a.lock.Unlock()
+	sort.Slice(funnel, func(i, j int) bool {
+		if funnel[i].Sessions != funnel[j].Sessions {
+			return funnel[i].Sessions > funnel[j].Sessions
+		}
+		return funnel[i].Node < funnel[j].Node
+	})
+	return funnel
+}
+
+// Writes the funnel statistics as CSV with a header row.
+func (a *USSDAnalytics) WriteFunnelCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"node", "visits", "sessions", "completions", "drop_offs"})
+	for _, s := range a.Funnel() {
+		out.Write([]string{s.Node, strconv.Itoa(s.Visits), strconv.Itoa(s.Sessions), strconv.Itoa(s.Completions), strconv.Itoa(s.DropOffs)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Writes the funnel statistics as a JSON array.
+func (a *USSDAnalytics) WriteFunnelJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(a.Funnel())
+}
+
+// Writes the recorded session paths as CSV with a header row and a row for every step.
+func (a *USSDAnalytics) WritePathsCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"session_id", "address", "step", "node", "input", "time", "end_reason", "end"})
+	for _, p := range a.Paths() {
+		for i, s := range p.Steps {
+			out.Write([]string{p.SessionID, p.Address, strconv.Itoa(i + 1), s.Node, s.Input, s.Time.Format(time.RFC3339), p.EndReason, p.End.Format(time.RFC3339)})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Writes the recorded session paths as a JSON array.
+func (a *USSDAnalytics) WritePathsJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(a.Paths())
+}
@@ -0,0 +1,45 @@
+package ideamart
+
+/*
+	Parsing of the USSD code dialled to start a session, e.g. #771*45*2#.
+*/
+
+import "strings"
+
+// The code a subscriber dialled to start a USSD session.
+// For #771*45*2# the service code is "771" and the parameters are "45" and "2".
+type USSDDialString struct {
+	Raw         string
+	ServiceCode string
+	Params      []string
+}
+
+// The parsed dial string of a session started by the subscriber, stored in the session data by the USSD client.
+// It is not set for sessions started by the application, or if the message was not a valid dial string.
+//
+//	dial, ok := ideamart.USSDDialStringKey.Get(sessionData)
+var USSDDialStringKey = NewUSSDSessionKey[USSDDialString]("ideamart.dial")
+
+// Parses a dial string such as *771# or #771*45*2#. The leading * or # and the trailing # are optional.
+// The service code must be numeric. Parameters may be empty, as in *771**2#, but may not contain #.
+// Returns ErrUSSDDialStringInvalid if the string is not a dial string.
+func ParseUSSDDialString(s string) (USSDDialString, error) {
+	code := strings.TrimSpace(s)
+	if strings.HasPrefix(code, "*") || strings.HasPrefix(code, "#") {
+		code = code[1:]
+	}
+	code = strings.TrimSuffix(code, "#")
+	parts := strings.Split(code, "*")
+	if !isDigits(parts[0]) || strings.Contains(code, "#") {
+		return USSDDialString{}, ErrUSSDDialStringInvalid
+	}
+	return USSDDialString{Raw: s, ServiceCode: parts[0], Params: parts[1:]}, nil
+}
+
+// Returns the parameter at index i, or an empty string if there are not that many.
+func (d USSDDialString) Param(i int) string {
+	if i < 0 || i >= len(d.Params) {
+		return ""
+	}
+	return d.Params[i]
+}
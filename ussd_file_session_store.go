@@ -0,0 +1,196 @@
+package ideamart
+
+/*
+	File-backed persistent USSD session store.
+	Each session is kept in its own file, so sessions survive restarts and can be shared between
+	several servers through a mounted volume.
+*/
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	fileSessionSuffix     = ".session"
+	fileSessionTempPrefix = "tmp-"
+)
+
+// A USSD session store keeping sessions in files in a directory.
+// Implements USSDSessionStoreV2. Files are replaced atomically, so concurrent readers never see a partly
+// written session. Sessions idle for longer than the idle timeout are treated as missing, and removed by Sweep.
+// Sessions are encoded with GobSessionCodec unless another codec is set, so custom types stored in session data
+// must be registered with RegisterUSSDSessionType.
+type fileSessionStore struct {
+	dir           string
+	idleTimeout   time.Duration
+	codec         USSDSessionCodec
+	evictCallback func(session USSDSession, reason string)
+}
+
+// Returns a file-backed session store using the given directory, which is created if it does not exist.
+// Zero idleTimeout keeps sessions until they are deleted.
+func NewFileSessionStore(dir string, idleTimeout time.Duration) (*fileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir, idleTimeout: idleTimeout, codec: GobSessionCodec}, nil
+}
+
+// Sets the codec used to encode sessions. This should be set before the store is used,
+// as sessions saved with one codec cannot be read with another.
+func (s *fileSessionStore) SetCodec(codec USSDSessionCodec) {
+	s.codec = codec
+}
+
+// Sets a callback to be called with every session discarded for being idle, with the reason USSDSessionEvictedIdle.
+// This should be set before the store is used.
+func (s *fileSessionStore) SetEvictionCallback(callback func(session USSDSession, reason string)) {
+	s.evictCallback = callback
+}
+
+// Removes an expired session file, and calls the eviction callback with the session.
+func (s *fileSessionStore) evict(path string) {
+	data, readErr := os.ReadFile(path)
+	if err := os.Remove(path); err != nil || s.evictCallback == nil || readErr != nil {
+		// Another server removed it first, or there is nothing to report.
+		return
+	}
+	session := USSDSession{}
+	if err := s.codec.Unmarshal(data, &session); err == nil {
+		s.evictCallback(session, USSDSessionEvictedIdle)
+	}
+}
+
+func (s *fileSessionStore) path(id string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(id))+fileSessionSuffix)
+}
+
+func (s *fileSessionStore) expired(info os.FileInfo, now time.Time) bool {
+	return s.idleTimeout > 0 && now.Sub(info.ModTime()) > s.idleTimeout
+}
+
+// Gets a USSD session by id. Returns ErrSessionNotFound if it does not exist or has expired.
+func (s *fileSessionStore) Get(ctx context.Context, id string) (*USSDSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := s.path(id)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(info, time.Now()) {
+		s.evict(path)
+		return nil, ErrSessionNotFound
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := USSDSession{}
+	if err := s.codec.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Saves a USSD session, replacing any earlier version of it.
+func (s *fileSessionStore) Save(ctx context.Context, session USSDSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := s.codec.Marshal(session)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, fileSessionTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(session.ID))
+}
+
+// Deletes a USSD session.
+func (s *fileSessionStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Marks a USSD session as used now. Returns ErrSessionNotFound if it does not exist or has expired.
+func (s *fileSessionStore) Touch(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(id)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if s.expired(info, now) {
+		s.evict(path)
+		return ErrSessionNotFound
+	}
+	err = os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// Removes expired sessions. Call it periodically, as expired sessions are otherwise only removed when looked up.
+// Temporary files older than the idle timeout, left behind if the process stopped while saving, are removed too.
+func (s *fileSessionStore) Sweep(ctx context.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, fileSessionTempPrefix) && !strings.HasSuffix(name, fileSessionSuffix) {
+			if info, err := entry.Info(); err == nil && s.expired(info, now) {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, fileSessionSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && s.expired(info, now) {
+			s.evict(filepath.Join(s.dir, name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package ideamart
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStoreTouchDoesNotReviveExpiredSessions(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileSessionStore(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted := []string{}
+	s.SetEvictionCallback(func(session USSDSession, reason string) { evicted = append(evicted, session.ID) })
+	if err := s.Save(ctx, newUSSDSession("1", "tel:94771000001")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(s.path("1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Touch(ctx, "1"); err != ErrSessionNotFound {
+		t.Errorf("got %v touching an expired session, want %v", err, ErrSessionNotFound)
+	}
+	if _, err := s.Get(ctx, "1"); err != ErrSessionNotFound {
+		t.Errorf("got %v getting an expired session after touching it, want %v", err, ErrSessionNotFound)
+	}
+	if len(evicted) != 1 || evicted[0] != "1" {
+		t.Errorf("got evicted sessions %v, want [1]", evicted)
+	}
+}
+
+func TestFileSessionStoreSweepRemovesStaleTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileSessionStore(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"tmp-1", "tmp-2"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(filepath.Join(dir, "tmp-1"), old, old)
+	if err := s.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp-1")); !os.IsNotExist(err) {
+		t.Error("stale temporary file was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp-2")); err != nil {
+		t.Error("temporary file of a save in progress was removed: ", err)
+	}
+}
@@ -0,0 +1,113 @@
+package ideamart
+
+/*
+	Validated input fields for USSD menus.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validates a USSD input and converts it to the value stored in the session.
+// The error message is shown to the subscriber above the prompt when they are asked to try again.
+type USSDField func(input string) (value interface{}, err error)
+
+// A field accepting input matching a regular expression. The value is the trimmed input string.
+func RegexField(pattern, errorText string) USSDField {
+	re := regexp.MustCompile(pattern)
+	return func(input string) (interface{}, error) {
+		input = strings.TrimSpace(input)
+		if !re.MatchString(input) {
+			return nil, errors.New(errorText)
+		}
+		return input, nil
+	}
+}
+
+// A field accepting a whole number between min and max inclusive. The value is an int.
+func IntRangeField(min, max int) USSDField {
+	return func(input string) (interface{}, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(input))
+		if err != nil || n < min || n > max {
+			return nil, fmt.Errorf("Please enter a number from %d to %d.", min, max)
+		}
+		return n, nil
+	}
+}
+
+// A field accepting an amount between min and max inclusive, with at most two decimal places. The value is a float64.
+func AmountField(min, max float64) USSDField {
+	re := regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+	return func(input string) (interface{}, error) {
+		input = strings.TrimSpace(input)
+		amount, err := strconv.ParseFloat(input, 64)
+		if !re.MatchString(input) || err != nil || amount < min || amount > max {
+			return nil, fmt.Errorf("Please enter an amount from %.2f to %.2f.", min, max)
+		}
+		return amount, nil
+	}
+}
+
+// A field accepting a date in the given layout, e.g. "02/01/2006" for DD/MM/YYYY.
+// The value is a time.Time at midnight Sri Lankan time.
+func DateField(layout, example string) USSDField {
+	return func(input string) (interface{}, error) {
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(input), timestampLocation)
+		if err != nil {
+			return nil, fmt.Errorf("Please enter a date like %s.", example)
+		}
+		return t, nil
+	}
+}
+
+// A field accepting one of the given choices, ignoring case. The value is the matching choice.
+func ChoiceField(choices ...string) USSDField {
+	return func(input string) (interface{}, error) {
+		input = strings.TrimSpace(input)
+		for _, c := range choices {
+			if strings.EqualFold(input, c) {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("Please enter one of %s.", strings.Join(choices, ", "))
+	}
+}
+
+// A field accepting a numeric PIN of the given length. The value is the PIN string.
+func PINField(length int) USSDField {
+	return func(input string) (interface{}, error) {
+		input = strings.TrimSpace(input)
+		if len(input) != length || !isDigits(input) {
+			return nil, fmt.Errorf("Please enter a %d digit PIN.", length)
+		}
+		return input, nil
+	}
+}
+
+var nicPattern = regexp.MustCompile(`^([0-9]{2})([0-9]{3})[0-9]{4}[VX]$|^((?:19|20)[0-9]{2})([0-9]{3})[0-9]{5}$`)
+
+// A field accepting a Sri Lankan national identity card number, in either the old nine digit and letter form
+// (e.g. 853400937V) or the new twelve digit form (e.g. 198534000937). The day of the year encoded in the
+// number is checked, allowing for the 500 added for women. The value is the number in upper case.
+func NICField() USSDField {
+	return func(input string) (interface{}, error) {
+		nic := strings.ToUpper(strings.TrimSpace(input))
+		m := nicPattern.FindStringSubmatch(nic)
+		if m == nil {
+			return nil, errors.New("Please enter a valid NIC number.")
+		}
+		day, _ := strconv.Atoi(m[2] + m[4])
+		if day > 500 {
+			day -= 500
+		}
+		if day < 1 || day > 366 {
+			return nil, errors.New("Please enter a valid NIC number.")
+		}
+		return nic, nil
+	}
+}
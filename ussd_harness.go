@@ -0,0 +1,199 @@
+package ideamart
+
+/*
+	Scripted USSD conversations for testing USSD flows in-process, without the Ideamart simulator or a network.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a conversation waits for a reply unless the harness sets another timeout.
+const DefaultUSSDTestTimeout = 5 * time.Second
+
+// Drives a USSD client in-process, as Ideamart would, for tests.
+// Messages are passed to the client's HandleIncoming method, and the client's responses are captured instead of being
+// sent, so the client needs neither a SendEndpoint nor a network. If the client has no session store, an in-memory
+// store is set. The client should not be used for anything else once the harness is created.
+//
+//	h := ideamart.NewUSSDTestHarness(client)
+//	err := h.NewConversation("tel:94771234567").Run(
+//		ideamart.USSDScriptStep{Input: "*771#", ExpectContains: "1. Balance"},
+//		ideamart.USSDScriptStep{Input: "1", ExpectOperation: ideamart.MobileTermiatedFinal},
+//	)
+type USSDTestHarness struct {
+	Timeout time.Duration
+	client  *USSDClient
+	lock    sync.Mutex
+	replies map[string]chan USSDMobileTerminatedRequest
+	lastID  atomic.Int64
+}
+
+// Returns a harness driving the client.
+func NewUSSDTestHarness(client *USSDClient) *USSDTestHarness {
+	h := &USSDTestHarness{Timeout: DefaultUSSDTestTimeout, client: client, replies: map[string]chan USSDMobileTerminatedRequest{}}
+	if client.SessionStore == nil && client.SessionStoreV2 == nil {
+		store := NewInMemorySessionStore(1000)
+		client.SessionStore = &store
+	}
+	client.sendFunc = h.capture
+	return h
+}
+
+// Returns the channel the client's requests for a session are captured in.
+func (h *USSDTestHarness) session(id string) chan USSDMobileTerminatedRequest {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	replies := h.replies[id]
+	if replies == nil {
+		replies = make(chan USSDMobileTerminatedRequest, 100)
+		h.replies[id] = replies
+	}
+	return replies
+}
+
+func (h *USSDTestHarness) capture(request USSDMobileTerminatedRequest) error {
+	h.session(request.SessionID) <- request
+	return nil
+}
+
+// Returns a conversation with the client from a subscriber address in a new session. Start it with Dial or Run.
+func (h *USSDTestHarness) NewConversation(address string) *USSDConversation {
+	return &USSDConversation{h, address, "test-" + strconv.FormatInt(h.lastID.Add(1), 10), false}
+}
+
+// Returns a conversation in a session the client started with StartSession, to take the subscriber's part in it.
+// The client's first request is received with Receive.
+func (h *USSDTestHarness) JoinConversation(sessionID, address string) *USSDConversation {
+	return &USSDConversation{h, address, sessionID, true}
+}
+
+// A conversation in a USSD session, from the subscriber's side.
+type USSDConversation struct {
+	harness   *USSDTestHarness
+	Address   string
+	SessionID string
+	started   bool
+}
+
+// Starts the session by dialling a code such as *771#, and returns the client's reply.
+func (c *USSDConversation) Dial(dialString string) (USSDMobileTerminatedRequest, error) {
+	c.started = true
+	return c.send(MobileOriginatedInitial, dialString)
+}
+
+// Replies to the client's last message, and returns the client's reply.
+func (c *USSDConversation) Reply(input string) (USSDMobileTerminatedRequest, error) {
+	return c.send(MobileOriginatedContinue, input)
+}
+
+func (c *USSDConversation) send(operation MobileOriginatedUSSDOperation, message string) (USSDMobileTerminatedRequest, error) {
+	body, err := json.Marshal(USSDMobileOriginatedRequest{
+		ApplicationID: c.harness.client.ApplicationID,
+		SourceAddress: c.Address,
+		USSDOperation: operation,
+		Message:       message,
+		SessionID:     c.SessionID,
+		Encoding:      "440",
+		Version:       "1.0",
+	})
+	if err != nil {
+		return USSDMobileTerminatedRequest{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		return USSDMobileTerminatedRequest{}, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	res := &ussdTestResponse{header: http.Header{}}
+	c.harness.client.HandleIncoming(res, req)
+	if res.status != http.StatusOK {
+		return USSDMobileTerminatedRequest{}, fmt.Errorf("USSD client responded to %s %q with status %d", operation, message, res.status)
+	}
+	return c.Receive()
+}
+
+// Waits for the client's next request in the session and returns it.
+func (c *USSDConversation) Receive() (USSDMobileTerminatedRequest, error) {
+	select {
+	case request := <-c.harness.session(c.SessionID):
+		return request, nil
+	case <-time.After(c.harness.Timeout):
+		return USSDMobileTerminatedRequest{}, fmt.Errorf("no USSD reply in session %s within %v", c.SessionID, c.harness.Timeout)
+	}
+}
+
+// A step of a scripted conversation: the subscriber's input and what the client should reply.
+// Expect must match the reply exactly, and ExpectContains must be part of it; either is ignored if empty.
+// ExpectOperation is the expected operation of the reply, such as MobileTermiatedFinal, and is ignored if empty.
+type USSDScriptStep struct {
+	Input           string
+	Expect          string
+	ExpectContains  string
+	ExpectOperation MobileTerminatedUSSDOperation
+}
+
+// Runs a scripted conversation, dialling the first step's input if the session has not started yet and replying with
+// the others. Returns an error describing the first reply which is not as expected.
+func (c *USSDConversation) Run(script ...USSDScriptStep) error {
+	for i, step := range script {
+		var reply USSDMobileTerminatedRequest
+		var err error
+		if c.started {
+			reply, err = c.Reply(step.Input)
+		} else {
+			reply, err = c.Dial(step.Input)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+		if err := step.check(reply); err != nil {
+			return fmt.Errorf("step %d (input %q): %v", i+1, step.Input, err)
+		}
+	}
+	return nil
+}
+
+func (step USSDScriptStep) check(reply USSDMobileTerminatedRequest) error {
+	if step.Expect != "" && reply.Message != step.Expect {
+		return fmt.Errorf("expected reply %q, got %q", step.Expect, reply.Message)
+	}
+	if step.ExpectContains != "" && !strings.Contains(reply.Message, step.ExpectContains) {
+		return fmt.Errorf("expected reply containing %q, got %q", step.ExpectContains, reply.Message)
+	}
+	if step.ExpectOperation != "" && reply.USSDOperation != step.ExpectOperation {
+		return fmt.Errorf("expected %s reply, got %s reply %q", step.ExpectOperation, reply.USSDOperation, reply.Message)
+	}
+	return nil
+}
+
+// Records the client's HTTP response to an incoming message.
+type ussdTestResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *ussdTestResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *ussdTestResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *ussdTestResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
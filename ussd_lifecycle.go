@@ -0,0 +1,54 @@
+package ideamart
+
+/*
+	USSD session lifecycle hooks.
+*/
+
+// Reasons for a USSD session ending, given to OnSessionEnd.
+const (
+	// A final response was delivered.
+	USSDSessionEndCompleted = "COMPLETED"
+	// The message handler failed, and the session was ended with the failure text.
+	USSDSessionEndFailed = "FAILED"
+	// A response could not be delivered.
+	USSDSessionEndUndelivered = "UNDELIVERED"
+	// The subscriber stopped replying, and the session store discarded the idle session.
+	USSDSessionEndTimeout = "TIMEOUT"
+	// The session store discarded the session to make space.
+	USSDSessionEndEvicted = "EVICTED"
+)
+
+// Returns a copy of the session to pass to hooks, with the address pseudonymised if the client has a Pseudonymizer.
+func (client *USSDClient) hookSession(session USSDSession) USSDSession {
+	session.RemoteAddress = client.Pseudonymizer.Pseudonym(session.RemoteAddress)
+	return session
+}
+
+func (client *USSDClient) sessionStarted(session USSDSession) {
+	if client.OnSessionStart != nil {
+		client.OnSessionStart(client.hookSession(session))
+	}
+}
+
+func (client *USSDClient) sessionEnded(session USSDSession, reason string) {
+	client.Analytics.end(client.hookSession(session), reason)
+	if client.OnSessionTimeout != nil && reason == USSDSessionEndTimeout {
+		client.OnSessionTimeout(client.hookSession(session))
+	}
+	if client.OnSessionEnd != nil {
+		client.OnSessionEnd(client.hookSession(session), reason)
+	}
+}
+
+// Reports a session discarded by the session store to the lifecycle hooks.
+// Sessions discarded for being idle are abandoned by the subscriber, and end with USSDSessionEndTimeout.
+// It has the signature of the eviction callback of the provided session stores, so it can be set as one:
+//
+//	store.SetEvictionCallback(client.SessionEvicted)
+func (client *USSDClient) SessionEvicted(session USSDSession, reason string) {
+	if reason == USSDSessionEvictedIdle {
+		client.sessionEnded(session, USSDSessionEndTimeout)
+		return
+	}
+	client.sessionEnded(session, USSDSessionEndEvicted)
+}
@@ -0,0 +1,275 @@
+package ideamart
+
+/*
+	Declarative USSD menus.
+	A menu is a graph of nodes, each of which is a screen with numbered options or a free text prompt.
+	The menu keeps track of the current node in the session data and works out whether to continue or end
+	the session, so it can be used directly as the IncomingMessageHandlerFunc of a USSD client.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Next node ID which goes back to the previous node.
+	USSDMenuBack = "..back"
+
+	ussdMenuNodeKey     = "ideamart.menu.node"
+	ussdMenuHistoryKey  = "ideamart.menu.history"
+	ussdMenuAttemptsKey = "ideamart.menu.attempts"
+
+	ussdMenuDefaultInvalidOptionText = "Invalid option."
+	ussdMenuDefaultMaxAttemptsText   = "Too many invalid attempts. Please try again later."
+)
+
+// The context a menu node is rendered or handles a reply in.
+// Input is the subscriber's reply, and is empty when rendering.
+type USSDMenuContext struct {
+	Address     string
+	Input       string
+	SessionData map[string]interface{}
+}
+
+// A numbered option on a menu screen.
+type USSDMenuOption struct {
+	Label string
+	Next  string
+}
+
+// A menu screen.
+// Text is shown at the top of the screen. If TextFunc is set it is used to build the text instead.
+// A node with Options lists them numbered from 1, and the subscriber's choice takes the menu to the option's Next node.
+// A node without options takes free text: the reply is stored in the session data under InputKey if that is set,
+// and the menu moves on to Next. If OnInput is set, it is called with the reply and the ID it returns, if any,
+// overrides Next. A node without options or a Next node ends the session.
+// If Field is set, free text is validated and converted by it before being stored, so the session data holds the
+// typed value, and the subscriber is asked again with the field's error message when the input is invalid.
+// After MaxAttempts invalid replies in a row, the menu goes to MaxAttemptsNext, or ends the session if that is empty.
+// Zero MaxAttempts allows any number of attempts.
+type USSDMenuNode struct {
+	ID              string
+	Text            string
+	TextFunc        func(ctx *USSDMenuContext) (string, error)
+	Options         []USSDMenuOption
+	InputKey        string
+	Field           USSDField
+	Next            string
+	OnInput         func(ctx *USSDMenuContext) (next string, err error)
+	MaxAttempts     int
+	MaxAttemptsNext string
+}
+
+func (n *USSDMenuNode) isFinal() bool {
+	return len(n.Options) == 0 && n.Next == "" && n.OnInput == nil
+}
+
+// A declarative USSD menu.
+// InvalidOptionText is shown above the current screen again when the subscriber picks an option which does not exist.
+// MaxAttemptsText ends the session when a node's MaxAttempts is exceeded and it has no MaxAttemptsNext.
+// Sessions start at the root node, or at the node deep linked to the parameters of the dial string.
+type USSDMenu struct {
+	Root              string
+	InvalidOptionText string
+	MaxAttemptsText   string
+	nodes             map[string]*USSDMenuNode
+	deepLinks         map[string]string
+}
+
+// Returns a new menu which starts at the node with the given ID.
+func NewUSSDMenu(root string) *USSDMenu {
+	return &USSDMenu{
+		Root:              root,
+		InvalidOptionText: ussdMenuDefaultInvalidOptionText,
+		MaxAttemptsText:   ussdMenuDefaultMaxAttemptsText,
+		nodes:             map[string]*USSDMenuNode{},
+		deepLinks:         map[string]string{},
+	}
+}
+
+// Adds a node to the menu, replacing any node with the same ID. Returns the menu so that calls can be chained.
+func (m *USSDMenu) Add(node USSDMenuNode) *USSDMenu {
+	m.nodes[node.ID] = &node
+	return m
+}
+
+// Starts sessions dialled with the given parameters at the node with the given ID. Returns the menu so that calls can
+// be chained. The parameters are separated by *, so with DeepLink("45*2", "topup") dialling #771*45*2# starts at the
+// "topup" node. The deep link with the most parameters matching the start of the dial string's parameters is used,
+// so further parameters, such as an amount, can follow and be read from USSDDialStringKey.
+func (m *USSDMenu) DeepLink(params, id string) *USSDMenu {
+	m.deepLinks[params] = id
+	return m
+}
+
+// Returns the node a session starts at, from its dial string.
+func (m *USSDMenu) start(sessionData map[string]interface{}) string {
+	dial, _ := USSDDialStringKey.Get(sessionData)
+	for n := len(dial.Params); n > 0; n-- {
+		if id, ok := m.deepLinks[strings.Join(dial.Params[:n], "*")]; ok {
+			return id
+		}
+	}
+	return m.Root
+}
+
+// Returns the node with the given ID, or nil if there is none.
+func (m *USSDMenu) Node(id string) *USSDMenuNode {
+	return m.nodes[id]
+}
+
+// Checks that the root node and every node referred to by an option, Next or a deep link exists.
+// It should be called once the menu is built.
+func (m *USSDMenu) Validate() error {
+	if m.nodes[m.Root] == nil {
+		return fmt.Errorf("USSD menu root node %q does not exist", m.Root)
+	}
+	for _, n := range m.nodes {
+		targets := []string{n.Next, n.MaxAttemptsNext}
+		for _, o := range n.Options {
+			if o.Next == "" {
+				return fmt.Errorf("USSD menu node %q has option %q without a next node", n.ID, o.Label)
+			}
+			targets = append(targets, o.Next)
+		}
+		for _, t := range targets {
+			if t != "" && t != USSDMenuBack && m.nodes[t] == nil {
+				return fmt.Errorf("USSD menu node %q refers to node %q which does not exist", n.ID, t)
+			}
+		}
+	}
+	for params, id := range m.deepLinks {
+		if m.nodes[id] == nil {
+			return fmt.Errorf("USSD menu deep link %q refers to node %q which does not exist", params, id)
+		}
+	}
+	return nil
+}
+
+func (m *USSDMenu) render(node *USSDMenuNode, ctx *USSDMenuContext) (string, error) {
+	text := node.Text
+	if node.TextFunc != nil {
+		var err error
+		if text, err = node.TextFunc(ctx); err != nil {
+			return "", err
+		}
+	}
+	lines := []string{}
+	if text != "" {
+		lines = append(lines, text)
+	}
+	for i, o := range node.Options {
+		lines = append(lines, strconv.Itoa(i+1)+". "+o.Label)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Works out the ID of the node to go to from a node given the subscriber's reply.
+// If the reply is invalid, the text to show when asking again is returned instead.
+func (m *USSDMenu) next(node *USSDMenuNode, ctx *USSDMenuContext) (next, retryText string, err error) {
+	if len(node.Options) > 0 {
+		choice, err := strconv.Atoi(strings.TrimSpace(ctx.Input))
+		if err != nil || choice < 1 || choice > len(node.Options) {
+			return "", m.InvalidOptionText, nil
+		}
+		return node.Options[choice-1].Next, "", nil
+	}
+	var value interface{} = ctx.Input
+	if node.Field != nil {
+		if value, err = node.Field(ctx.Input); err != nil {
+			return "", err.Error(), nil
+		}
+	}
+	if node.InputKey != "" {
+		ctx.SessionData[node.InputKey] = value
+	}
+	next = node.Next
+	if node.OnInput != nil {
+		n, err := node.OnInput(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		if n != "" {
+			next = n
+		}
+	}
+	return next, "", nil
+}
+
+// Moves to the given node, keeping track of the history for going back, and renders it.
+func (m *USSDMenu) enter(id string, ctx *USSDMenuContext, prefix string) (string, MobileTerminatedUSSDOperation, error) {
+	history, _ := ctx.SessionData[ussdMenuHistoryKey].([]string)
+	if id == USSDMenuBack {
+		if len(history) < 2 {
+			id = m.Root
+			history = nil
+		} else {
+			id = history[len(history)-2]
+			history = history[:len(history)-2]
+		}
+	}
+	node := m.nodes[id]
+	if node == nil {
+		return "", MobileTermiatedFinal, fmt.Errorf("USSD menu node %q does not exist", id)
+	}
+	ctx.SessionData[ussdMenuNodeKey] = id
+	ctx.SessionData[ussdMenuHistoryKey] = append(history, id)
+	text, err := m.render(node, ctx)
+	if err != nil {
+		return "", MobileTermiatedFinal, err
+	}
+	if prefix != "" {
+		text = prefix + "\n" + text
+	}
+	if node.isFinal() {
+		return text, MobileTermiatedFinal, nil
+	}
+	return text, MobileTermiatedContinue, nil
+}
+
+// Moves a session to the given node and renders it, as if the subscriber had navigated there.
+// Use it to show a node other than the root at the start of a session, such as one started with USSDClient.StartSession.
+func (m *USSDMenu) Enter(id, address string, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+	delete(sessionData, ussdMenuHistoryKey)
+	delete(sessionData, ussdMenuAttemptsKey)
+	return m.enter(id, &USSDMenuContext{Address: address, SessionData: sessionData}, "")
+}
+
+// Handles an incoming USSD message. This method can be used as the IncomingMessageHandlerFunc of a USSD client.
+func (m *USSDMenu) Handle(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+	ctx := &USSDMenuContext{Address: address, SessionData: sessionData}
+	current, _ := sessionData[ussdMenuNodeKey].(string)
+	node := m.nodes[current]
+	if operation == MobileOriginatedInitial || node == nil {
+		delete(sessionData, ussdMenuHistoryKey)
+		delete(sessionData, ussdMenuAttemptsKey)
+		return m.enter(m.start(sessionData), ctx, "")
+	}
+	ctx.Input = message
+	next, retryText, err := m.next(node, ctx)
+	if err != nil {
+		return "", MobileTermiatedFinal, err
+	}
+	ctx.Input = ""
+	if retryText != "" {
+		attempts, _ := sessionData[ussdMenuAttemptsKey].(int)
+		attempts++
+		if node.MaxAttempts > 0 && attempts >= node.MaxAttempts {
+			delete(sessionData, ussdMenuAttemptsKey)
+			if node.MaxAttemptsNext == "" {
+				return m.MaxAttemptsText, MobileTermiatedFinal, nil
+			}
+			return m.enter(node.MaxAttemptsNext, ctx, "")
+		}
+		sessionData[ussdMenuAttemptsKey] = attempts
+		history, _ := sessionData[ussdMenuHistoryKey].([]string)
+		if len(history) > 0 {
+			sessionData[ussdMenuHistoryKey] = history[:len(history)-1]
+		}
+		return m.enter(current, ctx, retryText)
+	}
+	delete(sessionData, ussdMenuAttemptsKey)
+	return m.enter(next, ctx, "")
+}
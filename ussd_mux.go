@@ -0,0 +1,168 @@
+package ideamart
+
+/*
+	Routing of USSD sessions to different handlers by service code or application ID.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	ussdMuxRouteKey = "ideamart.route"
+
+	ussdMuxDefaultNotFoundText = "This service is not available."
+)
+
+// A USSD message handler, with the signature of USSDClient.IncomingMessageHandlerFunc.
+type USSDHandlerFunc func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (response string, responseType MobileTerminatedUSSDOperation, err error)
+
+// Routes USSD sessions to handlers.
+// Its Handle method routes the sessions of one USSD client by the service code of their dial string. A session stays
+// with the handler it started with, and each handler has its own session data namespace, so handlers do not see or
+// overwrite each other's data. The dial string is visible to all of them under USSDDialStringKey.
+// The route for the service code "" handles sessions whose service code has no route of its own; if there is none
+// the session is ended with NotFoundText. Sessions started with USSDClient.StartSession have no dial string, so to
+// route one to a service set USSDDialStringKey in its session data to a USSDDialString with the service code.
+// Its HandleIncoming method routes incoming HTTP requests to USSD clients by application ID, for servers hosting
+// several Ideamart applications on one endpoint.
+type USSDMux struct {
+	NotFoundText string
+	routes       map[string]USSDHandlerFunc
+	clients      map[string]*USSDClient
+}
+
+// Returns an empty USSD mux.
+func NewUSSDMux() *USSDMux {
+	return &USSDMux{
+		NotFoundText: ussdMuxDefaultNotFoundText,
+		routes:       map[string]USSDHandlerFunc{},
+		clients:      map[string]*USSDClient{},
+	}
+}
+
+// Routes sessions dialled with the service code to the handler. Returns the mux so that calls can be chained.
+// A USSDMenu's Handle method can be used as the handler.
+func (m *USSDMux) HandleServiceCode(serviceCode string, handler USSDHandlerFunc) *USSDMux {
+	m.routes[serviceCode] = handler
+	return m
+}
+
+// Routes requests for the application ID to the client. Returns the mux so that calls can be chained.
+// Sessions of different applications may have the same ID, so clients sharing a session store should use
+// NamespaceUSSDSessionStore to keep their sessions apart.
+func (m *USSDMux) HandleApplication(applicationID string, client *USSDClient) *USSDMux {
+	m.clients[applicationID] = client
+	return m
+}
+
+// Handles an incoming USSD message by passing it on to the handler of the session's service.
+// This method can be used as the IncomingMessageHandlerFunc of a USSD client.
+func (m *USSDMux) Handle(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+	route, ok := sessionData[ussdMuxRouteKey].(string)
+	if !ok || operation == MobileOriginatedInitial {
+		dial, _ := USSDDialStringKey.Get(sessionData)
+		route = dial.ServiceCode
+		if m.routes[route] == nil {
+			route = ""
+		}
+		sessionData[ussdMuxRouteKey] = route
+	}
+	handler := m.routes[route]
+	if handler == nil {
+		return m.NotFoundText, MobileTermiatedFinal, nil
+	}
+	// Give the handler a view of the session data holding only its own keys, without the route prefix.
+	prefix := route + ":"
+	view := map[string]interface{}{}
+	for k, v := range sessionData {
+		if strings.HasPrefix(k, prefix) {
+			view[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	if dial, ok := USSDDialStringKey.Get(sessionData); ok {
+		USSDDialStringKey.Set(view, dial)
+	}
+	response, responseType, err := handler(address, message, operation, view)
+	for k := range sessionData {
+		if strings.HasPrefix(k, prefix) {
+			delete(sessionData, k)
+		}
+	}
+	USSDDialStringKey.Delete(view)
+	for k, v := range view {
+		sessionData[prefix+k] = v
+	}
+	// Keep the menu node where USSDAnalytics looks for it, qualified by the service code.
+	if node, ok := view[ussdMenuNodeKey].(string); ok {
+		sessionData[ussdMenuNodeKey] = strings.TrimPrefix(prefix+node, ":")
+	} else {
+		delete(sessionData, ussdMenuNodeKey)
+	}
+	return response, responseType, err
+}
+
+// This method should be attached as the handler to the USSD receiving endpoint of the server when the mux routes by
+// application ID. Requests for applications without a client get an error response.
+func (m *USSDMux) HandleIncoming(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	ussdReq := USSDMobileOriginatedRequest{}
+	if err == nil {
+		err = json.Unmarshal(body, &ussdReq)
+	}
+	if err != nil {
+		log.Print("Error handling incoming USSD message: ", err)
+		sendErrorResponse(res)
+		return
+	}
+	client := m.clients[ussdReq.ApplicationID]
+	if client == nil {
+		log.Print("No USSD client for application: ", ussdReq.ApplicationID)
+		sendErrorResponse(res)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	client.HandleIncoming(res, req)
+}
+
+type namespacedUSSDSessionStore struct {
+	store  USSDSessionStoreV2
+	prefix string
+}
+
+// Wraps a session store so that the session IDs used with it are kept apart from those of other namespaces.
+// Sessions are stored under the namespace followed by a colon and the session ID, which is also the ID the wrapped
+// store gives its eviction callback.
+func NamespaceUSSDSessionStore(store USSDSessionStoreV2, namespace string) USSDSessionStoreV2 {
+	return namespacedUSSDSessionStore{store, namespace + ":"}
+}
+
+func (s namespacedUSSDSessionStore) Get(ctx context.Context, id string) (*USSDSession, error) {
+	session, err := s.store.Get(ctx, s.prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	unwrapped := *session
+	unwrapped.ID = id
+	return &unwrapped, nil
+}
+
+func (s namespacedUSSDSessionStore) Save(ctx context.Context, session USSDSession) error {
+	session.ID = s.prefix + session.ID
+	return s.store.Save(ctx, session)
+}
+
+func (s namespacedUSSDSessionStore) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, s.prefix+id)
+}
+
+func (s namespacedUSSDSessionStore) Touch(ctx context.Context, id string) error {
+	return s.store.Touch(ctx, s.prefix+id)
+}
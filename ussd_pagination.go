@@ -0,0 +1,135 @@
+package ideamart
+
+/*
+	Pagination of USSD responses which do not fit on a single screen.
+*/
+
+import "strings"
+
+const (
+	ussdPagesKey      = "ideamart.pages"
+	ussdPageKey       = "ideamart.page"
+	ussdPagesFinalKey = "ideamart.pages.final"
+
+	ussdDefaultMoreInput = "98"
+	ussdDefaultMoreLabel = "More"
+	ussdDefaultBackInput = "0"
+	ussdDefaultBackLabel = "Back"
+)
+
+// Settings for splitting long USSD responses into pages.
+// Every page but the last gets a "More" option, and every page but the first a "Back" option.
+// The subscriber selects them by replying with MoreInput or BackInput, which the client handles itself.
+// Any other reply ends the pagination and is passed on to the message handler.
+// The last page of a final response ends the session, so it has no options.
+type USSDPagination struct {
+	MoreInput string
+	MoreLabel string
+	BackInput string
+	BackLabel string
+}
+
+// Returns pagination settings with the default "98. More" and "0. Back" options.
+func NewUSSDPagination() *USSDPagination {
+	return &USSDPagination{ussdDefaultMoreInput, ussdDefaultMoreLabel, ussdDefaultBackInput, ussdDefaultBackLabel}
+}
+
+func (p *USSDPagination) navigation(more, back bool) string {
+	nav := ""
+	if back {
+		nav += "\n" + p.BackInput + ". " + p.BackLabel
+	}
+	if more {
+		nav += "\n" + p.MoreInput + ". " + p.MoreLabel
+	}
+	return nav
+}
+
+// Splits text into pages which fit on a screen together with their navigation options, breaking at lines if possible.
+func (p *USSDPagination) split(text string) []string {
+	// Reserve room for both options on every page, so a page never has to be split again once its options are known.
+	nav := p.navigation(true, true)
+	pages := []string{}
+	page := ""
+	appendPart := func(part string) {
+		if page != "" && USSDMessageFits(page+"\n"+part+nav) {
+			page += "\n" + part
+			return
+		}
+		if page != "" {
+			pages = append(pages, page)
+		}
+		page = part
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if USSDMessageFits(line + nav) {
+			appendPart(line)
+			continue
+		}
+		// Break lines which do not fit on their own at character boundaries.
+		chunk := ""
+		for _, c := range line {
+			if !USSDMessageFits(chunk + string(c) + nav) {
+				appendPart(chunk)
+				chunk = ""
+			}
+			chunk += string(c)
+		}
+		appendPart(chunk)
+	}
+	return append(pages, page)
+}
+
+// Renders a page with its navigation options and returns it with the operation to send it with.
+func (p *USSDPagination) page(sessionData map[string]interface{}, index int) (string, MobileTerminatedUSSDOperation) {
+	pages, _ := sessionData[ussdPagesKey].([]string)
+	final, _ := sessionData[ussdPagesFinalKey].(bool)
+	sessionData[ussdPageKey] = index
+	last := index == len(pages)-1
+	if last && final {
+		p.clear(sessionData)
+		return pages[index], MobileTermiatedFinal
+	}
+	return pages[index] + p.navigation(!last, index > 0), MobileTermiatedContinue
+}
+
+func (p *USSDPagination) clear(sessionData map[string]interface{}) {
+	delete(sessionData, ussdPagesKey)
+	delete(sessionData, ussdPageKey)
+	delete(sessionData, ussdPagesFinalKey)
+}
+
+// Paginates a response from the message handler if it does not fit on a screen, and returns the first page.
+func (p *USSDPagination) start(sessionData map[string]interface{}, response string, responseType MobileTerminatedUSSDOperation) (string, MobileTerminatedUSSDOperation) {
+	p.clear(sessionData)
+	if USSDMessageFits(response) {
+		return response, responseType
+	}
+	sessionData[ussdPagesKey] = p.split(response)
+	sessionData[ussdPagesFinalKey] = responseType == MobileTermiatedFinal
+	return p.page(sessionData, 0)
+}
+
+// Handles a navigation reply while a response is being paginated.
+// Returns false if the reply is not for navigation, in which case it should be passed on to the message handler.
+func (p *USSDPagination) navigate(sessionData map[string]interface{}, message string) (string, MobileTerminatedUSSDOperation, bool) {
+	pages, _ := sessionData[ussdPagesKey].([]string)
+	index, _ := sessionData[ussdPageKey].(int)
+	if len(pages) == 0 {
+		return "", "", false
+	}
+	switch strings.TrimSpace(message) {
+	case p.MoreInput:
+		if index < len(pages)-1 {
+			response, responseType := p.page(sessionData, index+1)
+			return response, responseType, true
+		}
+	case p.BackInput:
+		if index > 0 {
+			response, responseType := p.page(sessionData, index-1)
+			return response, responseType, true
+		}
+	}
+	p.clear(sessionData)
+	return "", "", false
+}
@@ -0,0 +1,69 @@
+package ideamart
+
+/*
+	Network-initiated (push) USSD sessions, started by the application rather than the subscriber.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Operation of the request starting a session towards a subscriber.
+const MobileTermiatedInitial MobileTerminatedUSSDOperation = "mt-init"
+
+func newUSSDSessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Starts a USSD session towards a subscriber by showing them message, and returns the ID of the new session.
+// The address may be a pseudonym if the client has a Pseudonymizer. sessionData, which may be nil, becomes the data
+// of the session, so the message handler can tell what the subscriber is replying to.
+// The subscriber's replies are passed to the message handler like those in sessions they started, with the operation
+// MobileOriginatedContinue. To continue in a menu, render the first node with USSDMenu.Enter.
+// If the message cannot be delivered the session is ended, and the error is returned.
+func (client *USSDClient) StartSession(address, message string, sessionData map[string]interface{}) (string, error) {
+	addr, err := ParseAddress(client.Pseudonymizer.resolve(address))
+	if err != nil {
+		return "", err
+	}
+	id, err := newUSSDSessionID()
+	if err != nil {
+		return "", err
+	}
+	session := newUSSDSession(id, addr.String())
+	for k, v := range sessionData {
+		session.SessionData[k] = v
+	}
+	if client.Pagination != nil {
+		message, _ = client.Pagination.start(session.SessionData, message, MobileTermiatedContinue)
+	}
+	client.Analytics.visit(session.SessionData, "")
+	ctx, cancel := context.WithTimeout(context.Background(), ussdSessionStoreTimeout)
+	err = client.sessionStore().Save(ctx, session)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	client.sessionStarted(session)
+	ussdReq := USSDMobileTerminatedRequest{
+		ApplicationID:      client.ApplicationID,
+		Password:           client.Password,
+		Message:            message,
+		SessionID:          session.ID,
+		USSDOperation:      MobileTermiatedInitial,
+		DestinationAddress: session.RemoteAddress,
+	}
+	if err := client.send(ussdReq, time.Now().Add(ussdResponseTimeout)); err != nil {
+		client.storeSession(&session, MobileTermiatedFinal)
+		client.sessionEnded(session, USSDSessionEndUndelivered)
+		return "", err
+	}
+	return session.ID, nil
+}
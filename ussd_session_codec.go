@@ -0,0 +1,178 @@
+package ideamart
+
+/*
+	Serialisation of USSD sessions for persistent and remote session stores, and typed access to session data.
+*/
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Serialises USSD sessions, including their session data, for storage.
+// Values in the session data keep their types through a round trip as long as the types are registered with
+// RegisterUSSDSessionType. Strings, booleans, numbers, []string and time.Time are registered already.
+type USSDSessionCodec interface {
+	Marshal(session USSDSession) ([]byte, error)
+	Unmarshal(data []byte, session *USSDSession) error
+}
+
+var (
+	// Encodes sessions with encoding/gob. Compact, but only readable from Go.
+	GobSessionCodec USSDSessionCodec = gobSessionCodec{}
+	// Encodes sessions as JSON, tagging every session data value with the name of its type.
+	JSONSessionCodec USSDSessionCodec = jsonSessionCodec{}
+)
+
+var ussdSessionTypes = struct {
+	lock   sync.RWMutex
+	byName map[string]reflect.Type
+}{byName: map[string]reflect.Type{}}
+
+func init() {
+	for _, v := range []interface{}{"", false, 0, int64(0), float64(0), []string{}, time.Time{}} {
+		RegisterUSSDSessionType(v)
+	}
+}
+
+func ussdSessionTypeName(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// Registers the type of value so that values of it stored in session data survive serialisation by the codecs.
+// Call it during initialisation for every custom type stored in session data, as with gob.Register.
+func RegisterUSSDSessionType(value interface{}) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		return
+	}
+	ussdSessionTypes.lock.Lock()
+	defer ussdSessionTypes.lock.Unlock()
+	if _, ok := ussdSessionTypes.byName[ussdSessionTypeName(t)]; ok {
+		return
+	}
+	ussdSessionTypes.byName[ussdSessionTypeName(t)] = t
+	gob.Register(value)
+}
+
+type gobSessionCodec struct{}
+
+func (gobSessionCodec) Marshal(session USSDSession) ([]byte, error) {
+	data := bytes.Buffer{}
+	if err := gob.NewEncoder(&data).Encode(session); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func (gobSessionCodec) Unmarshal(data []byte, session *USSDSession) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(session); err != nil {
+		return err
+	}
+	if session.SessionData == nil {
+		session.SessionData = map[string]interface{}{}
+	}
+	return nil
+}
+
+type jsonSessionValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type jsonSession struct {
+	ID            string                      `json:"id"`
+	RemoteAddress string                      `json:"remoteAddress"`
+	SessionData   map[string]jsonSessionValue `json:"sessionData"`
+}
+
+type jsonSessionCodec struct{}
+
+func (jsonSessionCodec) Marshal(session USSDSession) ([]byte, error) {
+	s := jsonSession{session.ID, session.RemoteAddress, map[string]jsonSessionValue{}}
+	ussdSessionTypes.lock.RLock()
+	defer ussdSessionTypes.lock.RUnlock()
+	for key, value := range session.SessionData {
+		if value == nil {
+			continue
+		}
+		name := ussdSessionTypeName(reflect.TypeOf(value))
+		if _, ok := ussdSessionTypes.byName[name]; !ok {
+			return nil, fmt.Errorf("USSD session data %q has type %s which is not registered", key, name)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		s.SessionData[key] = jsonSessionValue{name, data}
+	}
+	return json.Marshal(s)
+}
+
+func (jsonSessionCodec) Unmarshal(data []byte, session *USSDSession) error {
+	s := jsonSession{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	session.ID, session.RemoteAddress, session.SessionData = s.ID, s.RemoteAddress, map[string]interface{}{}
+	ussdSessionTypes.lock.RLock()
+	defer ussdSessionTypes.lock.RUnlock()
+	for key, v := range s.SessionData {
+		t, ok := ussdSessionTypes.byName[v.Type]
+		if !ok {
+			return fmt.Errorf("USSD session data %q has type %s which is not registered", key, v.Type)
+		}
+		value := reflect.New(t)
+		if err := json.Unmarshal(v.Value, value.Interface()); err != nil {
+			return err
+		}
+		session.SessionData[key] = value.Elem().Interface()
+	}
+	return nil
+}
+
+// A key for a value of type T in USSD session data, saving type assertions in handlers.
+//
+//	var cartKey = ideamart.NewUSSDSessionKey[Cart]("cart")
+//	cart, ok := cartKey.Get(sessionData)
+//	cartKey.Set(sessionData, cart)
+type USSDSessionKey[T any] string
+
+// Returns a key for values of type T, and registers T so that the values survive serialisation.
+func NewUSSDSessionKey[T any](name string) USSDSessionKey[T] {
+	var zero T
+	RegisterUSSDSessionType(zero)
+	return USSDSessionKey[T](name)
+}
+
+// Gets the value for the key. Returns false if there is none or it is of another type.
+func (k USSDSessionKey[T]) Get(sessionData map[string]interface{}) (T, bool) {
+	value, ok := sessionData[string(k)].(T)
+	return value, ok
+}
+
+// Gets the value for the key, or the given default if there is none.
+func (k USSDSessionKey[T]) GetOr(sessionData map[string]interface{}, def T) T {
+	if value, ok := k.Get(sessionData); ok {
+		return value
+	}
+	return def
+}
+
+// Sets the value for the key.
+func (k USSDSessionKey[T]) Set(sessionData map[string]interface{}, value T) {
+	sessionData[string(k)] = value
+}
+
+// Removes the value for the key.
+func (k USSDSessionKey[T]) Delete(sessionData map[string]interface{}) {
+	delete(sessionData, string(k))
+}
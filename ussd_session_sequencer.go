@@ -0,0 +1,45 @@
+package ideamart
+
+/*
+	Serialisation of the processing of messages within a USSD session.
+*/
+
+import "sync"
+
+// Runs jobs for the same session one at a time in the order they were added, and jobs for different sessions
+// concurrently. A session has a goroutine only while it has jobs pending. The zero value is ready to use.
+type ussdSessionSequencer struct {
+	lock   sync.Mutex
+	queues map[string][]func()
+}
+
+// Adds a job for a session. It is run after all jobs added earlier for the session have finished.
+func (s *ussdSessionSequencer) run(id string, job func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queues == nil {
+		s.queues = map[string][]func(){}
+	}
+	queue, busy := s.queues[id]
+	s.queues[id] = append(queue, job)
+	if !busy {
+		go s.drain(id)
+	}
+}
+
+func (s *ussdSessionSequencer) drain(id string) {
+	for {
+		s.lock.Lock()
+		queue := s.queues[id]
+		if len(queue) == 0 {
+			delete(s.queues, id)
+			s.lock.Unlock()
+			return
+		}
+		job := queue[0]
+		queue[0] = nil
+		s.queues[id] = queue[1:]
+		s.lock.Unlock()
+		job()
+	}
+}
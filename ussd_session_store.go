@@ -6,67 +6,190 @@ package ideamart
 
 import (
 	"container/list"
-	"log"
 	"sync"
+	"time"
 )
 
+// Reasons for the in-memory session store evicting a session.
+const (
+	USSDSessionEvictedIdle = "IDLE"
+	USSDSessionEvictedFull = "FULL"
+
+	// Ideamart ends USSD sessions after a short network timeout, so sessions idle for longer than this are dead.
+	DefaultUSSDSessionIdleTimeout = 3 * time.Minute
+)
+
+type inMemorySession struct {
+	session    *USSDSession
+	lastAccess time.Time
+}
+
 // An in-memory seession store for use with the USSD client.
 // Automatically manages "garbage collection" by keeping track of updates.
 // maxSize is the maximum number of sessions it will store before discarding the last updated session.
+// Sessions which have not been used for longer than the idle timeout are discarded too. They are removed when they
+// are next looked up or space is needed, or by the background sweeper if it has been started.
 type inMemorySessionStore struct {
-	maxSize     int
-	currentSize int
-	gcList      list.List
-	lock        sync.Mutex
-	store       map[string]*list.Element
-}
-
-func (s *inMemorySessionStore) deleteOldestIfFull() {
-	log.Print(s.currentSize)
-	if s.currentSize >= s.maxSize {
-		e := s.gcList.Back()
-		session := e.Value.(*USSDSession)
-		delete(s.store, session.ID)
-		s.gcList.Remove(e)
-		s.currentSize--
+	maxSize       int
+	currentSize   int
+	idleTimeout   time.Duration
+	gcList        list.List
+	lock          sync.Mutex
+	store         map[string]*list.Element
+	evictCallback func(session USSDSession, reason string)
+	stopSweeper   chan struct{}
+}
+
+type evictedSession struct {
+	session *USSDSession
+	reason  string
+}
+
+func (s *inMemorySessionStore) remove(e *list.Element) *USSDSession {
+	session := e.Value.(*inMemorySession).session
+	delete(s.store, session.ID)
+	s.gcList.Remove(e)
+	s.currentSize--
+	return session
+}
+
+func (s *inMemorySessionStore) expired(e *list.Element, now time.Time) bool {
+	return s.idleTimeout > 0 && now.Sub(e.Value.(*inMemorySession).lastAccess) > s.idleTimeout
+}
+
+// Removes idle sessions, and the least recently used session if the store is full. The lock must be held.
+func (s *inMemorySessionStore) evict(now time.Time, makeSpace bool) []evictedSession {
+	evicted := []evictedSession{}
+	for e := s.gcList.Back(); e != nil && s.expired(e, now); e = s.gcList.Back() {
+		evicted = append(evicted, evictedSession{s.remove(e), USSDSessionEvictedIdle})
+	}
+	if makeSpace && s.currentSize >= s.maxSize && s.gcList.Len() > 0 {
+		evicted = append(evicted, evictedSession{s.remove(s.gcList.Back()), USSDSessionEvictedFull})
+	}
+	return evicted
+}
+
+// Calls the eviction callback for evicted sessions. Must be called without holding the lock.
+func (s *inMemorySessionStore) notifyEvicted(evicted []evictedSession) {
+	if s.evictCallback == nil {
+		return
+	}
+	for _, e := range evicted {
+		s.evictCallback(*e.session, e.reason)
 	}
 }
 
 // Gets an USSD session by id. Returns nil if none exists.
 func (s *inMemorySessionStore) Get(id string) *USSDSession {
 	s.lock.Lock()
+	var evicted []evictedSession
+	defer func() { s.notifyEvicted(evicted) }()
 	defer s.lock.Unlock()
 	e := s.store[id]
-	if e != nil {
-		s.gcList.MoveToFront(e)
-		if session, ok := e.Value.(*USSDSession); ok {
-			return session
-		} else {
-			panic("Data Store corrupted: non-string key value in garbage collector")
-			return nil
-		}
+	if e == nil {
+		return nil
+	}
+	now := time.Now()
+	if s.expired(e, now) {
+		evicted = append(evicted, evictedSession{s.remove(e), USSDSessionEvictedIdle})
+		return nil
 	}
-	return nil
+	entry := e.Value.(*inMemorySession)
+	entry.lastAccess = now
+	s.gcList.MoveToFront(e)
+	return entry.session
 }
 
-// Saves a new USSD session. Removes the "oldest" to make space if insufficient.
+// Saves a USSD session. Removes the "oldest" to make space if insufficient.
 func (s *inMemorySessionStore) Save(session USSDSession) {
 	s.lock.Lock()
+	var evicted []evictedSession
+	defer func() { s.notifyEvicted(evicted) }()
 	defer s.lock.Unlock()
-	s.deleteOldestIfFull()
-	if s.store[session.ID] == nil {
-		s.currentSize++
+	now := time.Now()
+	if e := s.store[session.ID]; e != nil {
+		entry := e.Value.(*inMemorySession)
+		entry.session, entry.lastAccess = &session, now
+		s.gcList.MoveToFront(e)
+		return
 	}
-	s.gcList.PushFront(&session)
+	evicted = s.evict(now, true)
+	s.gcList.PushFront(&inMemorySession{&session, now})
 	s.store[session.ID] = s.gcList.Front()
+	s.currentSize++
+}
+
+// Deletes a USSD session. The eviction callback is not called.
+func (s *inMemorySessionStore) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.store[id]; e != nil {
+		s.remove(e)
+	}
 }
 
 func (s *inMemorySessionStore) MaxSize() int {
 	return s.maxSize
 }
 
+// Sets how long a session may be idle before it is discarded. Zero keeps sessions until space is needed.
+func (s *inMemorySessionStore) SetIdleTimeout(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.idleTimeout = timeout
+}
+
+// Sets a callback to be called with every session discarded by the store, and the reason for discarding it.
+// This should be set before the store is used.
+func (s *inMemorySessionStore) SetEvictionCallback(callback func(session USSDSession, reason string)) {
+	s.evictCallback = callback
+}
+
+// Removes idle sessions now.
+func (s *inMemorySessionStore) Sweep() {
+	s.lock.Lock()
+	evicted := s.evict(time.Now(), false)
+	s.lock.Unlock()
+	s.notifyEvicted(evicted)
+}
+
+// Starts a background goroutine which removes idle sessions every interval, until StopSweeper is called.
+// Calling it again while the sweeper is running does nothing.
+func (s *inMemorySessionStore) StartSweeper(interval time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopSweeper != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.stopSweeper = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the background sweeper.
+func (s *inMemorySessionStore) StopSweeper() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopSweeper != nil {
+		close(s.stopSweeper)
+		s.stopSweeper = nil
+	}
+}
+
 // Returns a properly initialized in-memory sessions store.
 // maxSize is the maximum number of sessions it will store before discarding the "oldest" session.
+// Sessions idle for longer than DefaultUSSDSessionIdleTimeout are discarded too; use SetIdleTimeout to change that.
 func NewInMemorySessionStore(maxSize int) inMemorySessionStore {
-	return inMemorySessionStore{maxSize: maxSize, store: map[string]*list.Element{}}
+	return inMemorySessionStore{maxSize: maxSize, idleTimeout: DefaultUSSDSessionIdleTimeout, store: map[string]*list.Element{}}
 }
@@ -0,0 +1,67 @@
+package ideamart
+
+/*
+	Context aware USSD session store interface, and an adapter for stores implementing the original interface.
+*/
+
+import (
+	"context"
+	"time"
+)
+
+// How long the USSD client waits on the session store while processing a message outside the HTTP request.
+const ussdSessionStoreTimeout = 5 * time.Second
+
+// A USSD session store which can report failures, such as one backed by a database or a network service.
+// Get returns ErrSessionNotFound if there is no session with the ID.
+// Touch marks a session as used without changing it, for stores which expire idle sessions.
+// Delete removes a session, and does not fail if it does not exist.
+type USSDSessionStoreV2 interface {
+	Get(ctx context.Context, id string) (*USSDSession, error)
+	Save(ctx context.Context, session USSDSession) error
+	Delete(ctx context.Context, id string) error
+	Touch(ctx context.Context, id string) error
+}
+
+type ussdSessionStoreAdapter struct {
+	store USSDSessionStore
+}
+
+// Wraps a store implementing the original USSDSessionStore interface so that it can be used as a USSDSessionStoreV2.
+// Deleting only has an effect if the store has a Delete(id string) method, like the in-memory store.
+func AdaptUSSDSessionStore(store USSDSessionStore) USSDSessionStoreV2 {
+	return ussdSessionStoreAdapter{store}
+}
+
+func (a ussdSessionStoreAdapter) Get(ctx context.Context, id string) (*USSDSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if session := a.store.Get(id); session != nil {
+		return session, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (a ussdSessionStoreAdapter) Save(ctx context.Context, session USSDSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.store.Save(session)
+	return nil
+}
+
+func (a ussdSessionStoreAdapter) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := a.store.(interface{ Delete(string) }); ok {
+		d.Delete(id)
+	}
+	return nil
+}
+
+func (a ussdSessionStoreAdapter) Touch(ctx context.Context, id string) error {
+	_, err := a.Get(ctx, id)
+	return err
+}
@@ -0,0 +1,259 @@
+package ideamart
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUSSDAddress = "tel:94771000001"
+
+func newTestUSSDMenu() *USSDMenu {
+	offers := strings.Join([]string{strings.Repeat("A", 100), strings.Repeat("B", 100), strings.Repeat("C", 100)}, "\n")
+	menu := NewUSSDMenu("main").
+		Add(USSDMenuNode{ID: "main", Text: "Welcome", Options: []USSDMenuOption{{"Balance", "balance"}, {"Offers", "offers"}}}).
+		Add(USSDMenuNode{ID: "balance", Text: "Your balance is Rs. 100"}).
+		Add(USSDMenuNode{ID: "offers", Text: offers}).
+		Add(USSDMenuNode{ID: "topup", Text: "Enter amount", InputKey: "amount", Field: IntRangeField(10, 1000), Next: "topped", MaxAttempts: 3}).
+		Add(USSDMenuNode{ID: "topped", TextFunc: func(ctx *USSDMenuContext) (string, error) {
+			return fmt.Sprint("Topped up Rs. ", ctx.SessionData["amount"]), nil
+		}}).
+		DeepLink("45", "topup")
+	return menu
+}
+
+func newTestUSSDClient(handler func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error)) *USSDClient {
+	return &USSDClient{ApplicationID: "APP_1", IncomingMessageHandlerFunc: handler}
+}
+
+func TestUSSDMenuPagination(t *testing.T) {
+	menu := newTestUSSDMenu()
+	if err := menu.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestUSSDClient(menu.Handle)
+	client.Pagination = NewUSSDPagination()
+	h := NewUSSDTestHarness(client)
+	err := h.NewConversation(testUSSDAddress).Run(
+		USSDScriptStep{Input: "*771#", Expect: "Welcome\n1. Balance\n2. Offers", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "2", Expect: strings.Repeat("A", 100) + "\n98. More", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "98", Expect: strings.Repeat("B", 100) + "\n0. Back\n98. More", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "0", Expect: strings.Repeat("A", 100) + "\n98. More", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "98", ExpectContains: strings.Repeat("B", 100)},
+		USSDScriptStep{Input: "98", Expect: strings.Repeat("C", 100), ExpectOperation: MobileTermiatedFinal},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUSSDMenuDeepLinkAndFormRetry(t *testing.T) {
+	client := newTestUSSDClient(newTestUSSDMenu().Handle)
+	h := NewUSSDTestHarness(client)
+	err := h.NewConversation(testUSSDAddress).Run(
+		USSDScriptStep{Input: "#771*45#", Expect: "Enter amount", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "abc", Expect: "Please enter a number from 10 to 1000.\nEnter amount", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "5000", ExpectContains: "Please enter a number from 10 to 1000.", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "50", Expect: "Topped up Rs. 50", ExpectOperation: MobileTermiatedFinal},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	err = h.NewConversation(testUSSDAddress).Run(
+		USSDScriptStep{Input: "#771*45#", Expect: "Enter amount"},
+		USSDScriptStep{Input: "a", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "b", ExpectOperation: MobileTermiatedContinue},
+		USSDScriptStep{Input: "c", Expect: ussdMenuDefaultMaxAttemptsText, ExpectOperation: MobileTermiatedFinal},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUSSDHandlerPanicEndsSession(t *testing.T) {
+	client := newTestUSSDClient(func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+		if operation == MobileOriginatedInitial {
+			return "Enter your name", MobileTermiatedContinue, nil
+		}
+		panic("handler bug")
+	})
+	store := NewInMemorySessionStore(10)
+	client.SessionStore = &store
+	failures := make(chan error, 1)
+	client.HandlerFailureCallbackFunc = func(sessionID, address string, err error) { failures <- err }
+	h := NewUSSDTestHarness(client)
+	c := h.NewConversation(testUSSDAddress)
+	err := c.Run(
+		USSDScriptStep{Input: "*771#", Expect: "Enter your name"},
+		USSDScriptStep{Input: "Kamal", Expect: DefaultUSSDFailureText, ExpectOperation: MobileTermiatedFinal},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := <-failures; !strings.Contains(err.Error(), "handler bug") {
+		t.Errorf("got handler failure %v, want the panic", err)
+	}
+	if session := store.Get(c.SessionID); session != nil {
+		t.Errorf("got session %+v after the handler failed, want it deleted", session)
+	}
+}
+
+// Sends a message in a session without waiting for the client's reply.
+func sendTestUSSDMessage(t *testing.T, client *USSDClient, sessionID, message string) {
+	body, _ := json.Marshal(USSDMobileOriginatedRequest{
+		ApplicationID: client.ApplicationID,
+		SourceAddress: testUSSDAddress,
+		USSDOperation: MobileOriginatedContinue,
+		Message:       message,
+		SessionID:     sessionID,
+	})
+	res := httptest.NewRecorder()
+	client.HandleIncoming(res, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d for message %q", res.Code, message)
+	}
+}
+
+func TestUSSDSessionMessagesAreProcessedInOrder(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	client := newTestUSSDClient(func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+		if operation == MobileOriginatedInitial {
+			return "Welcome", MobileTermiatedContinue, nil
+		}
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		// Later messages would overtake this one if they were not processed in order.
+		if message == "1" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		messages, _ := sessionData["messages"].(string)
+		sessionData["messages"] = messages + message
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return messages + message, MobileTermiatedContinue, nil
+	})
+	h := NewUSSDTestHarness(client)
+	c := h.NewConversation(testUSSDAddress)
+	if _, err := c.Dial("*771#"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		sendTestUSSDMessage(t, client, c.SessionID, fmt.Sprint(i))
+	}
+	for _, want := range []string{"1", "12", "123", "1234", "12345"} {
+		reply, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Message != want {
+			t.Errorf("got reply %q, want %q", reply.Message, want)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if maxRunning > 1 {
+		t.Errorf("got %d messages of the session handled at once, want 1", maxRunning)
+	}
+}
+
+// A fake Ideamart USSD endpoint responding with the given status codes in turn, and then with the last one.
+type ussdTestServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	codes    []string
+	requests int
+}
+
+func newUSSDTestServer(codes ...string) *ussdTestServer {
+	s := &ussdTestServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		s.lock.Lock()
+		code := s.codes[len(s.codes)-1]
+		if s.requests < len(s.codes) {
+			code = s.codes[s.requests]
+		}
+		s.requests++
+		s.lock.Unlock()
+		json.NewEncoder(res).Encode(USSDMobileTerminatedResponse{Response: Response{StatusCode: code}})
+	}))
+	return s
+}
+
+func (s *ussdTestServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func TestUSSDResponseRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		codes      []string
+		retryCount int
+		timeout    time.Duration
+		err        error
+		requests   int
+	}{
+		{"success after a retryable error", []string{ErrTempSysErr.Code, statusCodeSuccess}, 3, time.Minute, nil, 2},
+		{"limited by RetryCount", []string{ErrTempSysErr.Code}, 3, time.Minute, ErrSendingFailed, 3},
+		{"limited by the deadline", []string{ErrTempSysErr.Code}, 10, ussdRetryInterval + ussdRetryInterval/2, ErrSendingFailed, 2},
+		{"non-retryable error", []string{ErrAuthFailed.Code, statusCodeSuccess}, 3, time.Minute, ErrAuthFailed, 1},
+		{"no RetryCount", []string{statusCodeSuccess}, 0, time.Minute, nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newUSSDTestServer(test.codes...)
+			defer server.Close()
+			request := USSDMobileTerminatedRequest{SessionID: "1", USSDOperation: MobileTermiatedFinal}
+			err := request.sendWithRetries(server.URL, test.retryCount, time.Now().Add(test.timeout))
+			if err != test.err {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+			if n := server.requestCount(); n != test.requests {
+				t.Errorf("got %d requests, want %d", n, test.requests)
+			}
+		})
+	}
+}
+
+func TestUSSDUndeliveredResponseEndsSession(t *testing.T) {
+	server := newUSSDTestServer(ErrAuthFailed.Code)
+	defer server.Close()
+	client := newTestUSSDClient(func(address, message string, operation MobileOriginatedUSSDOperation, sessionData map[string]interface{}) (string, MobileTerminatedUSSDOperation, error) {
+		return "Welcome", MobileTermiatedContinue, nil
+	})
+	client.SendEndpoint = server.URL
+	client.RetryCount = 3
+	store := NewInMemorySessionStore(10)
+	client.SessionStore = &store
+	failures := make(chan error, 1)
+	client.DeliveryFailureCallbackFunc = func(sessionID, address string, err error) { failures <- err }
+	body, _ := json.Marshal(USSDMobileOriginatedRequest{SourceAddress: testUSSDAddress, USSDOperation: MobileOriginatedInitial, Message: "*771#", SessionID: "1"})
+	client.HandleIncoming(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	select {
+	case err := <-failures:
+		if err != ErrAuthFailed {
+			t.Errorf("got delivery failure %v, want %v", err, ErrAuthFailed)
+		}
+	case <-time.After(DefaultUSSDTestTimeout):
+		t.Fatal("delivery failure was not reported")
+	}
+	if session := store.Get("1"); session != nil {
+		t.Errorf("got session %+v after the response was not delivered, want it deleted", session)
+	}
+	if n := server.requestCount(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}